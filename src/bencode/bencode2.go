@@ -121,6 +121,12 @@ func ParseBencoded2(r io.Reader) any {
 	return container.Obj()
 }
 
+// Unmarshaler is implemented by types that can't be filled in field by
+// field, e.g. because they come in more than one shape
+type Unmarshaler interface {
+	UnmarshalBencode(val any) error
+}
+
 func fillStruct(o any, d map[string]any) {
 	var structure reflect.Type
 	if reflect.TypeOf(o).Kind() != reflect.Struct {
@@ -133,6 +139,10 @@ func fillStruct(o any, d map[string]any) {
 
 	// using this for recursive calls for e.g. slices of slices
 	fill = func(containerType reflect.Type, val any, field reflect.Value) {
+		if unmarshaler, ok := field.Addr().Interface().(Unmarshaler); ok {
+			common.Check(unmarshaler.UnmarshalBencode(val))
+			return
+		}
 		switch containerType.Kind() {
 		case reflect.Struct:
 			oo := reflect.New(containerType)
@@ -161,7 +171,7 @@ func fillStruct(o any, d map[string]any) {
 	}
 }
 
-func ParseFromReader[S data.BETorrent | data.BETrackerResponse](r io.Reader) *S {
+func ParseFromReader[S data.BETorrent | data.BETrackerResponse | data.BEScrapeResponse](r io.Reader) *S {
 	obj := ParseBencoded2(r)
 	d, ok := obj.(map[string]any)
 	if !ok {
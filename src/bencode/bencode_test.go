@@ -4,9 +4,11 @@ import (
 	"axiomiety/go-bt/bencode"
 	"axiomiety/go-bt/data"
 	"bytes"
+	"fmt"
 	"io"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -320,3 +322,25 @@ func TestBencodeStruct(t *testing.T) {
 		t.Errorf("exepcted %+v, got %+v", expected, val)
 	}
 }
+
+func TestCompactPeers(t *testing.T) {
+	// one IPv4 peer on port 6881 and one IPv6 peer on port 51413
+	peers := "\x0a\x00\x00\x01\x1a\xe1"
+	peers6 := "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\xc8\xd5"
+	response := fmt.Sprintf("d8:intervali1800e5:peers%d:%s6:peers6%d:%se", len(peers), peers, len(peers6), peers6)
+	trackerResponse := bencode.ParseFromReader[data.BETrackerResponse](strings.NewReader(response))
+	expected := data.BEPeers{{IP: "10.0.0.1", Port: 6881}}
+	if !reflect.DeepEqual(trackerResponse.Peers, expected) {
+		t.Errorf("expected %+v, got %+v", expected, trackerResponse.Peers)
+	}
+	expected6 := data.BEPeers6{{IP: "2001:db8::1", Port: 51413}}
+	if !reflect.DeepEqual(trackerResponse.Peers6, expected6) {
+		t.Errorf("expected %+v, got %+v", expected6, trackerResponse.Peers6)
+	}
+
+	// peer lists have to be made of whole peers
+	var truncated data.BEPeers
+	if err := truncated.UnmarshalBencode(peers[:5]); err == nil {
+		t.Errorf("expected a truncated peer list to be rejected")
+	}
+}
@@ -5,3 +5,7 @@ func Check(err error) {
 		panic(err)
 	}
 }
+
+// how we identify ourselves to trackers and other peers
+const CLIENT_ID = "GB"
+const CLIENT_VERSION = "0001"
@@ -3,9 +3,15 @@ package data
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math/bits"
 )
 
+// BEP 10 - set in the 6th reserved byte of the handshake
+const ExtensionProtocolBit byte = 0x10
+
 type Handshake struct {
 	PstrLen  byte
 	Pstr     []byte
@@ -24,6 +30,10 @@ func GetHanshake(peerId [20]byte, infoHash [20]byte) *Handshake {
 	}
 }
 
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&ExtensionProtocolBit > 0
+}
+
 func (h *Handshake) ToBytes() []byte {
 	buffer := new(bytes.Buffer)
 	buffer.WriteByte(h.PstrLen)
@@ -34,6 +44,30 @@ func (h *Handshake) ToBytes() []byte {
 	return buffer.Bytes()
 }
 
+// ReadHandshake reads the peer's side of the handshake - pstrlen first,
+// which tells us how much more there is to read
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	pstrLength := int(buf[0])
+	if pstrLength == 0 {
+		return nil, errors.New("handshake with an empty pstr")
+	}
+	buf = make([]byte, pstrLength+8+20+20)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return &Handshake{
+		PstrLen:  byte(pstrLength),
+		Pstr:     buf[:pstrLength],
+		Reserved: [8]byte(buf[pstrLength : pstrLength+8]),
+		InfoHash: [20]byte(buf[pstrLength+8 : pstrLength+8+20]),
+		PeerId:   [20]byte(buf[pstrLength+8+20:]),
+	}, nil
+}
+
 type Message struct {
 	Length    [4]byte
 	MessageId byte
@@ -52,41 +86,285 @@ func (m *Message) ToBytes() []byte {
 	return buffer.Bytes()
 }
 
+// the length prefix covers the message ID as well as the payload
+func newMessage(messageId byte, payload []byte) *Message {
+	ll := make([]byte, 4)
+	binary.BigEndian.PutUint32(ll, uint32(1+len(payload)))
+	return &Message{
+		Length:    [4]byte(ll),
+		MessageId: messageId,
+		Payload:   payload,
+	}
+}
+
+// used by have, request, piece and cancel which all start with uint32s
+func uint32sToBytes(vals ...uint32) []byte {
+	buffer := make([]byte, 4*len(vals))
+	for idx, val := range vals {
+		binary.BigEndian.PutUint32(buffer[4*idx:], val)
+	}
+	return buffer
+}
+
 func KeepAlive() *Message {
 	return &Message{}
 }
 
 func Choke() *Message {
-	return &Message{
-		Length: [4]byte{0, 0, 0, 1},
-	}
+	return newMessage(MsgChoke, nil)
+}
+
+func Unchoke() *Message {
+	return newMessage(MsgUnchoke, nil)
+}
+
+func Interested() *Message {
+	return newMessage(MsgInterested, nil)
+}
+
+func NotInterested() *Message {
+	return newMessage(MsgNotInterested, nil)
+}
+
+func Have(index uint32) *Message {
+	return newMessage(MsgHave, uint32sToBytes(index))
+}
+
+func Bitfield(b *BitField) *Message {
+	// we don't want later updates to our bitfield to change the message
+	payload := make([]byte, len(b.Field))
+	copy(payload, b.Field)
+	return newMessage(MsgBitfield, payload)
 }
 
 func Request(index uint32, begin uint32, length uint32) *Message {
-	buffer := make([]byte, 4*3)
-	binary.BigEndian.PutUint32(buffer[0:], index)
-	binary.BigEndian.PutUint32(buffer[4:], begin)
-	binary.BigEndian.PutUint32(buffer[8:], length)
-	ll := make([]byte, 4)
-	binary.BigEndian.PutUint32(ll, 13)
-	return &Message{
-		Length:    [4]byte(ll),
-		MessageId: MsgRequest,
-		Payload:   buffer,
+	return newMessage(MsgRequest, uint32sToBytes(index, begin, length))
+}
+
+func Piece(index uint32, begin uint32, block []byte) *Message {
+	return newMessage(MsgPiece, append(uint32sToBytes(index, begin), block...))
+}
+
+func Cancel(index uint32, begin uint32, length uint32) *Message {
+	return newMessage(MsgCancel, uint32sToBytes(index, begin, length))
+}
+
+func Port(port uint16) *Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, port)
+	return newMessage(MsgPort, payload)
+}
+
+// BEP 10 - the first byte of the payload is the extended message ID,
+// with 0 being the extended handshake
+func Extended(extendedId byte, payload []byte) *Message {
+	return newMessage(MsgExtended, append([]byte{extendedId}, payload...))
+}
+
+// PeerMessage is what ReadMessage hands back - one concrete type per message ID
+type PeerMessage interface {
+	ToMessage() *Message
+}
+
+type KeepAliveMessage struct{}
+
+type ChokeMessage struct{}
+
+type UnchokeMessage struct{}
+
+type InterestedMessage struct{}
+
+type NotInterestedMessage struct{}
+
+type HaveMessage struct {
+	Index uint32
+}
+
+type BitfieldMessage struct {
+	BitField BitField
+}
+
+type RequestMessage struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+type PieceMessage struct {
+	Index uint32
+	Begin uint32
+	Block []byte
+}
+
+type CancelMessage struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+type PortMessage struct {
+	Port uint16
+}
+
+type ExtendedMessage struct {
+	ExtendedId byte
+	Payload    []byte
+}
+
+// peers are free to send messages we don't know about (e.g. extensions),
+// which we're supposed to ignore rather than drop the connection
+type UnknownMessage struct {
+	MessageId byte
+	Payload   []byte
+}
+
+func (m *KeepAliveMessage) ToMessage() *Message     { return KeepAlive() }
+func (m *ChokeMessage) ToMessage() *Message         { return Choke() }
+func (m *UnchokeMessage) ToMessage() *Message       { return Unchoke() }
+func (m *InterestedMessage) ToMessage() *Message    { return Interested() }
+func (m *NotInterestedMessage) ToMessage() *Message { return NotInterested() }
+func (m *HaveMessage) ToMessage() *Message          { return Have(m.Index) }
+func (m *BitfieldMessage) ToMessage() *Message      { return Bitfield(&m.BitField) }
+func (m *RequestMessage) ToMessage() *Message       { return Request(m.Index, m.Begin, m.Length) }
+func (m *PieceMessage) ToMessage() *Message         { return Piece(m.Index, m.Begin, m.Block) }
+func (m *CancelMessage) ToMessage() *Message        { return Cancel(m.Index, m.Begin, m.Length) }
+func (m *PortMessage) ToMessage() *Message          { return Port(m.Port) }
+func (m *ExtendedMessage) ToMessage() *Message      { return Extended(m.ExtendedId, m.Payload) }
+func (m *UnknownMessage) ToMessage() *Message       { return newMessage(m.MessageId, m.Payload) }
+
+var ErrMessageTooLong = errors.New("message exceeds maximum length")
+var ErrInvalidPayload = errors.New("invalid payload")
+
+// ReadMessage reads a single length-prefixed message from r. Messages longer
+// than maxLen (which excludes the 4-byte length prefix) are rejected before
+// anything gets allocated for them.
+func ReadMessage(r io.Reader, maxLen uint32) (PeerMessage, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 {
+		return &KeepAliveMessage{}, nil
+	}
+	if length > maxLen {
+		return nil, fmt.Errorf("%w: %d > %d", ErrMessageTooLong, length, maxLen)
+	}
+	buffer := make([]byte, length)
+	if _, err := io.ReadFull(r, buffer); err != nil {
+		return nil, err
+	}
+	return ParseMessage(buffer[0], buffer[1:])
+}
+
+// ParseMessage validates the payload for the given message ID and converts
+// it to its typed counterpart
+func ParseMessage(messageId byte, payload []byte) (PeerMessage, error) {
+	expectLength := func(expected int) error {
+		if len(payload) != expected {
+			return fmt.Errorf("%w: message %d should have a %d-byte payload, got %d", ErrInvalidPayload, messageId, expected, len(payload))
+		}
+		return nil
+	}
+
+	switch messageId {
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested:
+		if err := expectLength(0); err != nil {
+			return nil, err
+		}
+		switch messageId {
+		case MsgChoke:
+			return &ChokeMessage{}, nil
+		case MsgUnchoke:
+			return &UnchokeMessage{}, nil
+		case MsgInterested:
+			return &InterestedMessage{}, nil
+		default:
+			return &NotInterestedMessage{}, nil
+		}
+	case MsgHave:
+		if err := expectLength(4); err != nil {
+			return nil, err
+		}
+		return &HaveMessage{Index: binary.BigEndian.Uint32(payload)}, nil
+	case MsgBitfield:
+		if len(payload) == 0 {
+			return nil, fmt.Errorf("%w: empty bitfield", ErrInvalidPayload)
+		}
+		return &BitfieldMessage{BitField: BitField{Field: payload}}, nil
+	case MsgRequest, MsgCancel:
+		if err := expectLength(12); err != nil {
+			return nil, err
+		}
+		index := binary.BigEndian.Uint32(payload[0:])
+		begin := binary.BigEndian.Uint32(payload[4:])
+		length := binary.BigEndian.Uint32(payload[8:])
+		if messageId == MsgRequest {
+			return &RequestMessage{Index: index, Begin: begin, Length: length}, nil
+		}
+		return &CancelMessage{Index: index, Begin: begin, Length: length}, nil
+	case MsgPiece:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("%w: piece message with a %d-byte payload", ErrInvalidPayload, len(payload))
+		}
+		return &PieceMessage{
+			Index: binary.BigEndian.Uint32(payload[0:]),
+			Begin: binary.BigEndian.Uint32(payload[4:]),
+			Block: payload[8:],
+		}, nil
+	case MsgPort:
+		if err := expectLength(2); err != nil {
+			return nil, err
+		}
+		return &PortMessage{Port: binary.BigEndian.Uint16(payload)}, nil
+	case MsgExtended:
+		if len(payload) == 0 {
+			return nil, fmt.Errorf("%w: extended message without an ID", ErrInvalidPayload)
+		}
+		return &ExtendedMessage{ExtendedId: payload[0], Payload: payload[1:]}, nil
+	default:
+		return &UnknownMessage{MessageId: messageId, Payload: payload}, nil
 	}
 }
 
 type BitField struct {
 	Field []byte
+	// the number of pieces tracked - the last byte may contain spare bits,
+	// in which case this is what tells us where to stop
+	Size uint32
+}
+
+func NewBitField(numPieces uint32) BitField {
+	return BitField{
+		Field: make([]byte, (numPieces+7)/8),
+		Size:  numPieces,
+	}
 }
 
 func (b *BitField) NumPieces() uint32 {
+	if b.Size > 0 {
+		return b.Size
+	}
 	// each byte represents 8 blocks
-	return uint32(cap(b.Field))
+	return uint32(len(b.Field)) * 8
+}
+
+// Validate checks a bitfield received from a peer against the number of
+// pieces in the torrent - spare bits at the end have to be cleared
+func (b *BitField) Validate(numPieces uint32) error {
+	if len(b.Field) != int((numPieces+7)/8) {
+		return fmt.Errorf("%w: expected a %d-byte bitfield, got %d", ErrInvalidPayload, (numPieces+7)/8, len(b.Field))
+	}
+	if spareBits := numPieces % 8; spareBits > 0 {
+		if b.Field[len(b.Field)-1]&byte(0xff>>spareBits) != 0 {
+			return fmt.Errorf("%w: spare bits are set", ErrInvalidPayload)
+		}
+	}
+	return nil
 }
 
 func (b *BitField) HasPiece(idx uint32) bool {
-	if idx > b.NumPieces() {
+	if idx >= b.NumPieces() {
 		panic(fmt.Sprintf("We only have %d blocks but requested block number %d", b.NumPieces(), idx))
 	}
 
@@ -97,8 +375,17 @@ func (b *BitField) HasPiece(idx uint32) bool {
 	return b.Field[byteIdx]&offset > 0
 }
 
+// Count returns the number of pieces set
+func (b *BitField) Count() uint32 {
+	count := uint32(0)
+	for _, val := range b.Field {
+		count += uint32(bits.OnesCount8(val))
+	}
+	return count
+}
+
 func (b *BitField) SetPiece(idx uint32) {
-	if idx > b.NumPieces() {
+	if idx >= b.NumPieces() {
 		panic(fmt.Sprintf("We only have %d blocks but tried to set block number %d", b.NumPieces(), idx))
 	}
 
@@ -119,4 +406,6 @@ const (
 	MsgRequest       byte = 6
 	MsgPiece         byte = 7
 	MsgCancel        byte = 8
+	MsgPort          byte = 9
+	MsgExtended      byte = 20
 )
@@ -2,6 +2,9 @@ package data
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"reflect"
 	"testing"
 )
 
@@ -62,3 +65,90 @@ func TestReques(t *testing.T) {
 		t.Errorf("exepected %v but got %v", expected, msg.ToBytes())
 	}
 }
+
+func TestMessageBuilders(t *testing.T) {
+	bitfield := BitField{Field: []byte{0xf0}}
+	testCases := []struct {
+		msg      *Message
+		expected []byte
+	}{
+		{Unchoke(), []byte{0, 0, 0, 1, 1}},
+		{Interested(), []byte{0, 0, 0, 1, 2}},
+		{NotInterested(), []byte{0, 0, 0, 1, 3}},
+		{Have(258), []byte{0, 0, 0, 5, 4, 0, 0, 1, 2}},
+		{Bitfield(&bitfield), []byte{0, 0, 0, 2, 5, 0xf0}},
+		{Piece(1, 2, []byte("abc")), []byte{0, 0, 0, 12, 7, 0, 0, 0, 1, 0, 0, 0, 2, 'a', 'b', 'c'}},
+		{Cancel(1, 2, 3), []byte{0, 0, 0, 13, 8, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}},
+		{Port(6881), []byte{0, 0, 0, 3, 9, 0x1a, 0xe1}},
+	}
+	for _, tc := range testCases {
+		if !bytes.Equal(tc.msg.ToBytes(), tc.expected) {
+			t.Errorf("expected %v, got %v", tc.expected, tc.msg.ToBytes())
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	messages := []PeerMessage{
+		&KeepAliveMessage{},
+		&ChokeMessage{},
+		&UnchokeMessage{},
+		&InterestedMessage{},
+		&NotInterestedMessage{},
+		&HaveMessage{Index: 42},
+		&BitfieldMessage{BitField: BitField{Field: []byte{0xde, 0xad}}},
+		&RequestMessage{Index: 1, Begin: 16384, Length: 16384},
+		&PieceMessage{Index: 1, Begin: 16384, Block: []byte("deadbeef")},
+		&CancelMessage{Index: 1, Begin: 16384, Length: 16384},
+		&PortMessage{Port: 6881},
+		&ExtendedMessage{ExtendedId: 0, Payload: []byte("de")},
+		&UnknownMessage{MessageId: 21, Payload: []byte{0}},
+	}
+	buffer := &bytes.Buffer{}
+	for _, msg := range messages {
+		buffer.Write(msg.ToMessage().ToBytes())
+	}
+	for _, expected := range messages {
+		msg, err := ReadMessage(buffer, 1024)
+		if err != nil {
+			t.Fatalf("unexpected error reading %T: %s", expected, err)
+		}
+		if !reflect.DeepEqual(msg, expected) {
+			t.Errorf("expected %+v, got %+v", expected, msg)
+		}
+	}
+
+	// anything longer than the max length should be rejected
+	_, err := ReadMessage(bytes.NewReader(Piece(0, 0, make([]byte, 32)).ToBytes()), 16)
+	if !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("expected ErrMessageTooLong, got %v", err)
+	}
+
+	// a have message with a truncated index
+	_, err = ReadMessage(bytes.NewReader([]byte{0, 0, 0, 3, MsgHave, 0, 1}), 16)
+	if !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("expected ErrInvalidPayload, got %v", err)
+	}
+
+	// not enough bytes for the advertised length
+	_, err = ReadMessage(bytes.NewReader([]byte{0, 0, 0, 5, MsgHave, 0, 1}), 16)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestBitFieldValidate(t *testing.T) {
+	b := NewBitField(10)
+	if len(b.Field) != 2 || b.NumPieces() != 10 {
+		t.Errorf("expected 2 bytes for 10 pieces, got %d bytes for %d pieces", len(b.Field), b.NumPieces())
+	}
+	if err := (&BitField{Field: []byte{0xff, 0xc0}}).Validate(10); err != nil {
+		t.Errorf("expected a valid bitfield, got %s", err)
+	}
+	if err := (&BitField{Field: []byte{0xff, 0xe0}}).Validate(10); err == nil {
+		t.Errorf("expected an error as spare bits are set")
+	}
+	if err := (&BitField{Field: []byte{0xff}}).Validate(10); err == nil {
+		t.Errorf("expected an error as the bitfield is too short")
+	}
+}
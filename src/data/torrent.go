@@ -22,13 +22,24 @@ type BEFile struct {
 
 func (i *BEInfo) GetPieceSize(idx uint32) uint32 {
 	numPieces := i.GetNumPieces()
-	if idx == numPieces-1 {
-		return min(i.PieceLength, i.GetTotalLength()%i.PieceLength)
+	// the last piece is usually shorter, unless the total length
+	// happens to be a multiple of the piece length
+	if remainder := i.GetTotalLength() % i.PieceLength; idx == numPieces-1 && remainder > 0 {
+		return remainder
 	} else {
 		return i.PieceLength
 	}
 }
 
+// GetFiles returns the files making up the torrent - a single-file
+// torrent is stored under its name
+func (i *BEInfo) GetFiles() []BEFile {
+	if len(i.Files) == 0 {
+		return []BEFile{{Path: []string{i.Name}, Length: int(i.Length)}}
+	}
+	return i.Files
+}
+
 func (i *BEInfo) GetTotalLength() uint32 {
 	totalLength := i.Length
 	if len(i.Files) > 0 {
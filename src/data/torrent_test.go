@@ -33,4 +33,10 @@ func TestGetPieceLength(t *testing.T) {
 	if beinfo.GetPieceSize(1) != 40 {
 		t.Errorf("expected piece 1 to be of size %d, got %d instead", 40, pieceSize)
 	}
+
+	// the last piece is a full one if the length is a multiple of the piece length
+	beinfo.Files[1].Length = 110
+	if pieceSize = beinfo.GetPieceSize(1); pieceSize != beinfo.PieceLength {
+		t.Errorf("expected piece 1 to be of size %d, got %d instead", beinfo.PieceLength, pieceSize)
+	}
 }
@@ -1,18 +1,93 @@
 package data
 
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
 type BEPeer struct {
 	Id   string `bencode:"peer_id"`
 	IP   string `bencode:"ip"`
 	Port uint32 `bencode:"port"`
 }
 
+// BEPeers is the peer list of a tracker response, which comes either as a
+// list of dicts or, in compact form (BEP 23), as a string with 6 bytes per
+// peer - 4 for the IP and 2 for the port
+type BEPeers []BEPeer
+
+// BEPeers6 is the IPv6 flavour of BEPeers (BEP 7), with 18 bytes per peer
+type BEPeers6 []BEPeer
+
+func (p *BEPeers) UnmarshalBencode(val any) error {
+	peers, err := parsePeers(val, net.IPv4len)
+	*p = peers
+	return err
+}
+
+func (p *BEPeers6) UnmarshalBencode(val any) error {
+	peers, err := parsePeers(val, net.IPv6len)
+	*p = peers
+	return err
+}
+
+func parsePeers(val any, ipLen int) ([]BEPeer, error) {
+	peers := []BEPeer{}
+	switch val := val.(type) {
+	case string:
+		peerLen := ipLen + 2
+		if len(val)%peerLen != 0 {
+			return nil, fmt.Errorf("compact peer list of %d bytes isn't a multiple of %d", len(val), peerLen)
+		}
+		for offset := 0; offset < len(val); offset += peerLen {
+			peers = append(peers, BEPeer{
+				IP:   net.IP(val[offset : offset+ipLen]).String(),
+				Port: uint32(binary.BigEndian.Uint16([]byte(val[offset+ipLen : offset+peerLen]))),
+			})
+		}
+	case []any:
+		for _, item := range val {
+			dict, ok := item.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("expected a peer dict, got %T", item)
+			}
+			id, _ := dict["peer_id"].(string)
+			ip, _ := dict["ip"].(string)
+			port, _ := dict["port"].(int)
+			if ip == "" || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("invalid peer %s:%d", ip, port)
+			}
+			peers = append(peers, BEPeer{Id: id, IP: ip, Port: uint32(port)})
+		}
+	default:
+		return nil, fmt.Errorf("unexpected peer list of type %T", val)
+	}
+	return peers, nil
+}
+
 type BETrackerResponse struct {
-	Complete   int64    `bencode:"complete"`   // seeds
-	Incomplete int64    `bencode:"incomplete"` // leechers
-	Interval   int64    `bencode:"interval"`   // in seconds
-	Peers      []BEPeer `bencode:"peers"`
+	// when set, the tracker turned us down and nothing else is
+	FailureReason  string `bencode:"failure reason"`
+	WarningMessage string `bencode:"warning message"`
+	Complete       int64  `bencode:"complete"`     // seeds
+	Incomplete     int64  `bencode:"incomplete"`   // leechers
+	Interval       int64  `bencode:"interval"`     // in seconds
+	MinInterval    int64  `bencode:"min interval"` // in seconds
+	// to be sent back on our next announces
+	TrackerId string   `bencode:"tracker id"`
+	Peers     BEPeers  `bencode:"peers"`
+	Peers6    BEPeers6 `bencode:"peers6"`
 }
 
+// what we tell the tracker about where we're at - regular announces don't
+// have an event
+const (
+	EVENT_STARTED   = "started"
+	EVENT_COMPLETED = "completed"
+	EVENT_STOPPED   = "stopped"
+)
+
 type TrackerQuery struct {
 	InfoHash   string `url:"info_hash"`
 	PeerId     string `url:"peer_id"`
@@ -21,6 +96,64 @@ type TrackerQuery struct {
 	Downloaded uint   `url:"downloaded"`
 	Left       uint   `url:"left"`
 	Event      string `url:"event"`
-	// Compact    bool   `url:"compact"`
-	Numwant uint `url:"numwant"`
+	TrackerId  string `url:"trackerid,omitempty,escape"`
+	Compact    bool   `url:"compact"`
+	// trackers take numwant=0 literally
+	Numwant uint `url:"numwant,omitempty"`
+	// lets the tracker know it's still us if our IP changes - it's never
+	// shared with other peers
+	Key string `url:"key,omitempty,escape"`
+	// where peers should connect to if it isn't the address the tracker
+	// sees us on, e.g. when we're behind a proxy
+	IP   string `url:"ip,omitempty,escape"`
+	IPv4 string `url:"ipv4,omitempty,escape"`
+	IPv6 string `url:"ipv6,omitempty,escape"`
+	// ignored when compact is set
+	NoPeerId      bool `url:"no_peer_id,omitempty"`
+	SupportCrypto bool `url:"supportcrypto,omitempty"`
+	RequireCrypto bool `url:"requirecrypto,omitempty"`
+	// bytes we threw away, from pieces that failed the hash check and
+	// blocks we got twice - they're included in downloaded
+	Corrupt   uint `url:"corrupt,omitempty"`
+	Redundant uint `url:"redundant,omitempty"`
+}
+
+// BEScrapeFile is what a tracker knows about one of its torrents
+type BEScrapeFile struct {
+	Complete   int64 `bencode:"complete"`   // seeds
+	Downloaded int64 `bencode:"downloaded"` // completed downloads, ever
+	Incomplete int64 `bencode:"incomplete"` // leechers
+}
+
+// BEScrapeResponse is what an HTTP tracker sends back when scraped
+type BEScrapeResponse struct {
+	FailureReason string        `bencode:"failure reason"`
+	Files         BEScrapeFiles `bencode:"files"`
+}
+
+// BEScrapeFiles is keyed by raw info hash
+type BEScrapeFiles map[[20]byte]BEScrapeFile
+
+func (f *BEScrapeFiles) UnmarshalBencode(val any) error {
+	dict, ok := val.(map[string]any)
+	if !ok {
+		return fmt.Errorf("expected a dict of files, got %T", val)
+	}
+	files := BEScrapeFiles{}
+	for infoHash, stats := range dict {
+		statsDict, ok := stats.(map[string]any)
+		if len(infoHash) != 20 || !ok {
+			return fmt.Errorf("invalid entry for info hash %x", infoHash)
+		}
+		complete, _ := statsDict["complete"].(int)
+		downloaded, _ := statsDict["downloaded"].(int)
+		incomplete, _ := statsDict["incomplete"].(int)
+		files[[20]byte([]byte(infoHash))] = BEScrapeFile{
+			Complete:   int64(complete),
+			Downloaded: int64(downloaded),
+			Incomplete: int64(incomplete),
+		}
+	}
+	*f = files
+	return nil
 }
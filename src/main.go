@@ -8,15 +8,20 @@ import (
 	"axiomiety/go-bt/torrent"
 	"axiomiety/go-bt/tracker"
 	"bytes"
-	"crypto/rand"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 )
 
 func main() {
@@ -37,9 +42,26 @@ func main() {
 	trackerServe := trackerCmd.Bool("serve", false, "serve")
 	trackerDir := trackerCmd.String("dir", "", "directory with torrents, defaults to current directory")
 	trackerPort := trackerCmd.Int("port", 8080, "tracker listening port")
+	trackerProxy := trackerCmd.String("proxy", "", "http, https or socks5 proxy URL to reach the tracker through")
 
 	downloadCmd := flag.NewFlagSet("download", flag.ExitOnError)
 	downloadTorrentFile := downloadCmd.String("torrent", "", "file/stdin")
+	downloadStrategy := downloadCmd.String("strategy", "rarest", "piece picking strategy: rarest, random or sequential")
+	downloadSlots := downloadCmd.Int("slots", peer.DEFAULT_UPLOAD_SLOTS, "number of peers to upload to at once, excluding the optimistic unchoke")
+	downloadMaxDownload := downloadCmd.Int("maxDownload", 0, "download rate limit in KiB/s, 0 for unlimited")
+	downloadMaxUpload := downloadCmd.Int("maxUpload", 0, "upload rate limit in KiB/s, 0 for unlimited")
+	downloadSeed := downloadCmd.Bool("seed", false, "keep seeding once the download is complete")
+	downloadSnubTimeout := downloadCmd.Duration("snubTimeout", peer.SNUB_TIMEOUT, "how long a peer that unchoked us can go without sending anything before we consider it's snubbing us")
+	downloadAnnounceAll := downloadCmd.Bool("announceAll", false, "announce to every tier of trackers, not just the first one that works")
+	downloadBans := downloadCmd.String("bans", defaultBanListPath(), "file banned peer IPs are kept in, empty to not keep them across runs")
+	downloadListen := downloadCmd.String("listen", "", "address to listen for peers on, empty for all of them")
+	downloadPort := downloadCmd.String("port", fmt.Sprint(peer.DEFAULT_LISTEN_PORT), "port to listen for peers on, or a range like 6881-6889 to try in turn")
+	downloadExternalIP := downloadCmd.String("externalIP", "", "IP peers should connect to us on, if it isn't the one trackers see")
+	downloadProxy := downloadCmd.String("proxy", "", "http, https or socks5 proxy URL to reach trackers through, defaults to HTTP_PROXY and friends")
+	downloadTrackerTimeout := downloadCmd.Duration("trackerTimeout", tracker.DEFAULT_TRACKER_TIMEOUT, "how long to wait for a tracker to answer")
+
+	scrapeCmd := flag.NewFlagSet("scrape", flag.ExitOnError)
+	scrapeProxy := scrapeCmd.String("proxy", "", "http, https or socks5 proxy URL to reach trackers through")
 
 	handshakeCmd := flag.NewFlagSet("handshake", flag.ExitOnError)
 	handshakeTorrentFile := handshakeCmd.String("torrent", "", "file/stdin")
@@ -64,11 +86,42 @@ func main() {
 		fmt.Printf("hex: %x\nurl: %s\n", digest, tracker.EncodeBytes(digest))
 	case "download":
 		downloadCmd.Parse(os.Args[2:])
+		setTrackerClient(*downloadTrackerTimeout, *downloadProxy)
 		manager := peer.FromTorrentFile(*downloadTorrentFile)
+		picker, err := peer.PickerFromName(*downloadStrategy)
+		common.Check(err)
+		manager.Pieces.Picker = picker
+		manager.UploadSlots = *downloadSlots
+		peer.GlobalDownloadLimiter.SetRate(*downloadMaxDownload * 1024)
+		peer.GlobalUploadLimiter.SetRate(*downloadMaxUpload * 1024)
+		manager.Seed = *downloadSeed
+		manager.SnubTimeout = *downloadSnubTimeout
+		if manager.Trackers != nil {
+			manager.Trackers.AnnounceToAll = *downloadAnnounceAll
+		}
+		manager.Bans, err = peer.NewBanList(*downloadBans)
+		common.Check(err)
+		firstPort, lastPort, err := peer.ParsePortRange(*downloadPort)
+		common.Check(err)
+		manager.ExternalIP = *downloadExternalIP
+		// we can still download if we can't listen, we just can't seed
+		listener := peer.NewListener(firstPort)
+		listener.Host = *downloadListen
+		listener.LastPort = lastPort
+		listener.Register(manager)
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+		if err := listener.Listen(ctx); err != nil {
+			// still tell trackers the port we were asked for rather than the default
+			manager.ListenPort = uint(firstPort)
+			log.Printf("unable to listen for incoming peers: %s, announcing port %d anyway", err, firstPort)
+		} else {
+			manager.ListenPort = uint(listener.Port)
+		}
 		obj := bencode.GetDictFromFile(downloadTorrentFile)
 		infoDict := obj["info"].(map[string]any)
 		log.Printf("hash of idx 0: %s", hex.EncodeToString([]byte(infoDict["pieces"].(string)[0:20*1])))
-		manager.Run()
+		manager.Run(ctx)
 		log.Printf("manager has shut down")
 	case "handshake":
 		handshakeCmd.Parse(os.Args[2:])
@@ -77,14 +130,12 @@ func main() {
 		digest := torrent.CalculateInfoHashFromInfoDict(infoDict)
 		peerId, err := hex.DecodeString(*handhsakePeerId)
 		common.Check(err)
-		peerIdB := make([]byte, 20)
-		rand.Read(peerId)
 		bepeer := data.BEPeer{
 			IP:   *handshakePeerIp,
 			Port: uint32(*handshakePeerPort),
 			Id:   string(peerId),
 		}
-		ph := peer.MakePeerHandler(&bepeer, [20]byte(peerIdB), digest, infoDict["piece"].(uint32))
+		ph := peer.MakePeerHandler(&bepeer, peer.NewPeerId(), digest, uint32(len(infoDict["pieces"].(string))/20))
 		ph.Connect()
 		ph.Handshake()
 		log.Printf("peer state: %d", ph.State)
@@ -113,25 +164,88 @@ func main() {
 			digest := torrent.CalculateInfoHashFromInfoDict(infoDict)
 			baseUrl, err := url.Parse(obj["announce"].(string))
 			common.Check(err)
-			// generate a random peer ID
-			peerId := make([]byte, 20)
-			rand.Read(peerId)
 			q := data.TrackerQuery{
 				InfoHash: tracker.EncodeBytes(digest),
-				PeerId:   tracker.EncodeBytes([20]byte(peerId)),
-				Port:     6688,
+				PeerId:   tracker.EncodeBytes(peer.NewPeerId()),
+				Port:     peer.DEFAULT_LISTEN_PORT,
 				// Compact:  false,
 				// if it's too small, some trackers won't send us peers!
 				Left:    45536,
 				Numwant: 100,
 			}
-			resp := tracker.QueryTrackerRaw(baseUrl, &q)
+			setTrackerClient(tracker.DEFAULT_TRACKER_TIMEOUT, *trackerProxy)
+			resp, err := tracker.DefaultClient.AnnounceRaw(context.Background(), baseUrl, &q)
+			common.Check(err)
 			raw := bencode.ParseBencoded2(bytes.NewReader(resp))
 			b, err := json.MarshalIndent(raw, "", "  ")
 			common.Check(err)
 			fmt.Printf("%s", string(b))
 		}
+	case "scrape":
+		// scrape -- file1.torrent file2.torrent ...
+		scrapeCmd.Parse(os.Args[2:])
+		setTrackerClient(tracker.DEFAULT_TRACKER_TIMEOUT, *scrapeProxy)
+		scrapeTorrents(scrapeCmd.Args())
 	default:
 		panic("Unknown option!")
 	}
 }
+
+// scrapeTorrents prints what each torrent's tracker knows about it, asking
+// every tracker about all its torrents at once
+func scrapeTorrents(filenames []string) {
+	infoHashes := map[string][][20]byte{}
+	names := map[[20]byte]string{}
+	for _, filename := range filenames {
+		file, err := os.Open(filename)
+		common.Check(err)
+		btorrent := bencode.ParseFromReader[data.BETorrent](file)
+		file.Close()
+		announce := btorrent.Announce
+		if len(btorrent.AnnounceList) > 0 && len(btorrent.AnnounceList[0]) > 0 {
+			announce = btorrent.AnnounceList[0][0]
+		}
+		infoHash := torrent.CalculateInfoHash(&btorrent.Info)
+		infoHashes[announce] = append(infoHashes[announce], infoHash)
+		names[infoHash] = btorrent.Info.Name
+	}
+	for _, announce := range slices.Sorted(maps.Keys(infoHashes)) {
+		hashes := infoHashes[announce]
+		announceURL, err := url.Parse(announce)
+		common.Check(err)
+		files, err := tracker.Scrape(announceURL, hashes...)
+		if err != nil {
+			log.Printf("unable to scrape %s: %s", announce, err)
+			continue
+		}
+		for _, infoHash := range hashes {
+			stats, ok := files[infoHash]
+			if !ok {
+				fmt.Printf("%s: unknown to %s\n", names[infoHash], announce)
+				continue
+			}
+			fmt.Printf("%s: %d seeder(s), %d leecher(s), %d download(s)\n", names[infoHash], stats.Complete, stats.Incomplete, stats.Downloaded)
+		}
+	}
+}
+
+// setTrackerClient makes the default tracker client go through the proxy,
+// if there is one
+func setTrackerClient(timeout time.Duration, proxy string) {
+	var proxyURL *url.URL
+	if proxy != "" {
+		var err error
+		proxyURL, err = url.Parse(proxy)
+		common.Check(err)
+	}
+	tracker.DefaultClient = tracker.NewClient(timeout, proxyURL)
+}
+
+// somewhere that survives reboots, unlike the download directory
+func defaultBanListPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go-bt", "banned")
+}
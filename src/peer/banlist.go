@@ -0,0 +1,189 @@
+package peer
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// how many pieces a peer can be involved in that fail their hash check
+// before we stop talking to it
+const MAX_HASH_FAILURES = 3
+
+// BanList keeps track of the IPs that sent us bad data. Banned IPs are
+// written to a file, one per line, so they stay banned across runs.
+type BanList struct {
+	lock sync.Mutex
+	// empty if the list only lives in memory
+	path     string
+	banned   map[string]bool
+	failures map[string]int
+}
+
+// NewBanList loads the bans saved at path, if any
+func NewBanList(path string) (*BanList, error) {
+	b := &BanList{
+		path:     path,
+		banned:   map[string]bool{},
+		failures: map[string]int{},
+	}
+	if path == "" {
+		return b, nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		ip := strings.TrimSpace(scanner.Text())
+		if ip == "" {
+			continue
+		}
+		if net.ParseIP(ip) == nil {
+			log.Printf("ignoring invalid IP %q in %s", ip, path)
+			continue
+		}
+		b.banned[ip] = true
+	}
+	return b, scanner.Err()
+}
+
+func (b *BanList) IsBanned(ip string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.banned[ip]
+}
+
+// HashFailed records that the IP sent us part of a piece that turned out
+// to be bad, and returns true if that got it banned
+func (b *BanList) HashFailed(ip string) bool {
+	b.lock.Lock()
+	b.failures[ip] += 1
+	failures := b.failures[ip]
+	b.lock.Unlock()
+	if failures < MAX_HASH_FAILURES {
+		return false
+	}
+	b.Ban(ip)
+	return true
+}
+
+func (b *BanList) Ban(ip string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.banned[ip] {
+		return
+	}
+	log.Printf("banning %s", ip)
+	b.banned[ip] = true
+	if err := b.save(); err != nil {
+		log.Printf("unable to save the ban list: %s", err)
+	}
+}
+
+// save writes the list out in full. The caller must hold the lock.
+func (b *BanList) save() error {
+	if b.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+		return err
+	}
+	ips := []string{}
+	for ip := range b.banned {
+		ips = append(ips, ip)
+	}
+	slices.Sort(ips)
+	// so a crash halfway through doesn't lose the existing bans
+	tmpPath := b.path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(ips, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, b.path)
+}
+
+// what a block of a piece that failed its hash check looked like, so we
+// can tell who sent bad data once we have the real thing
+type suspectBlock struct {
+	digest [20]byte
+	ip     string
+}
+
+// pieceFailed penalises the peer that sent us a piece that failed its hash
+// check. When there's more than one of them we can't tell who's at fault,
+// so rather than penalising them all the piece gets downloaded again from
+// a single peer and we compare notes once it verifies - that's the "smart
+// ban", see pieceVerified.
+func (p *PeerManager) pieceFailed(piece *PartialPiece) {
+	p.PeerHandlerLock.Lock()
+	blocks := make([]suspectBlock, len(piece.Blocks))
+	ips := []string{}
+	for blockIdx, block := range piece.Blocks {
+		ref := piece.blockRef(blockIdx)
+		blocks[blockIdx] = suspectBlock{
+			digest: sha1.Sum(piece.Data[ref.Begin : ref.Begin+ref.Length]),
+			ip:     p.peerIPs[block.ReceivedFrom],
+		}
+		if ip := blocks[blockIdx].ip; ip != "" && !slices.Contains(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	// one bad copy is all we need to compare against
+	if _, ok := p.suspects[piece.Index]; !ok && len(ips) > 1 {
+		p.suspects[piece.Index] = blocks
+	}
+	_, suspected := p.suspects[piece.Index]
+	p.PeerHandlerLock.Unlock()
+
+	if len(ips) == 1 && p.Bans.HashFailed(ips[0]) {
+		p.dropBannedPeers(ips[0])
+	}
+	p.Pieces.PieceFailed(piece.Index, suspected)
+}
+
+// pieceVerified bans whoever sent us bad data for the piece last time
+// round, now that we know what it should have looked like
+func (p *PeerManager) pieceVerified(piece *PartialPiece) {
+	p.PeerHandlerLock.Lock()
+	suspects, ok := p.suspects[piece.Index]
+	delete(p.suspects, piece.Index)
+	p.PeerHandlerLock.Unlock()
+	if !ok {
+		return
+	}
+	culprits := []string{}
+	for blockIdx, suspect := range suspects {
+		ref := piece.blockRef(blockIdx)
+		if sha1.Sum(piece.Data[ref.Begin:ref.Begin+ref.Length]) != suspect.digest && suspect.ip != "" && !slices.Contains(culprits, suspect.ip) {
+			culprits = append(culprits, suspect.ip)
+		}
+	}
+	for _, ip := range culprits {
+		log.Printf("%s sent us bad data for piece %d", ip, piece.Index)
+		p.Bans.Ban(ip)
+		p.dropBannedPeers(ip)
+	}
+}
+
+func (p *PeerManager) dropBannedPeers(ip string) {
+	p.PeerHandlerLock.Lock()
+	defer p.PeerHandlerLock.Unlock()
+	for peerId, handler := range p.PeerHandlers {
+		if handler.Peer.IP == ip {
+			log.Printf("dropping banned peer %s", hex.EncodeToString([]byte(peerId)))
+			p.dropPeer(peerId)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package peer
+
+import (
+	"axiomiety/go-bt/data"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// how many times in a row we try to connect to a peer before giving up on
+// it - for good, even if trackers keep sending it our way
+const MAX_CONNECT_ATTEMPTS = 5
+
+// how long we wait before trying a peer again - this doubles with every
+// failure, up to MAX_CONNECT_BACKOFF
+const CONNECT_BACKOFF = 15 * time.Second
+const MAX_CONNECT_BACKOFF = 10 * time.Minute
+
+// Candidate is a peer we could connect to
+type Candidate struct {
+	Peer data.BEPeer
+	// failed attempts since we last managed to connect
+	Failures    int
+	NextAttempt time.Time
+	// whether we have a handler for it at the moment
+	Connecting bool
+	// set after MAX_CONNECT_ATTEMPTS failures, we don't dial it again
+	GaveUp bool
+}
+
+func candidateKey(peer *data.BEPeer) string {
+	return net.JoinHostPort(peer.IP, fmt.Sprintf("%d", peer.Port))
+}
+
+// CandidatePool is every peer we've heard of, wherever it came from, along
+// with how connecting to it went so far. Peers are keyed by address as
+// some sources don't tell us their IDs.
+type CandidatePool struct {
+	lock       sync.Mutex
+	candidates map[string]*Candidate
+}
+
+func NewCandidatePool() *CandidatePool {
+	return &CandidatePool{candidates: map[string]*Candidate{}}
+}
+
+// Add merges peers into the pool - peers we already know keep their
+// history, including the ones we gave up on
+func (c *CandidatePool) Add(peers ...data.BEPeer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, peer := range peers {
+		key := candidateKey(&peer)
+		if candidate, ok := c.candidates[key]; ok {
+			// the address is what matters, but an ID is nice to have
+			if candidate.Peer.Id == "" {
+				candidate.Peer.Id = peer.Id
+			}
+			continue
+		}
+		c.candidates[key] = &Candidate{Peer: peer}
+	}
+}
+
+// Identify records the ID of a peer we only knew the address of, so we
+// can tell it's already connected however else we hear about it
+func (c *CandidatePool) Identify(peer *data.BEPeer, id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if candidate, ok := c.candidates[candidateKey(peer)]; ok && candidate.Peer.Id == "" {
+		candidate.Peer.Id = id
+	}
+}
+
+// Next returns up to n peers we can connect to right now, the ones that
+// gave us the least trouble first, and marks them as connecting. Peers
+// for which skip returns true are left alone.
+func (c *CandidatePool) Next(now time.Time, n int, skip func(*data.BEPeer) bool) []data.BEPeer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	eligible := []*Candidate{}
+	for _, candidate := range c.candidates {
+		if candidate.Connecting || candidate.GaveUp || now.Before(candidate.NextAttempt) || skip(&candidate.Peer) {
+			continue
+		}
+		eligible = append(eligible, candidate)
+	}
+	slices.SortFunc(eligible, func(a, b *Candidate) int {
+		if a.Failures != b.Failures {
+			return a.Failures - b.Failures
+		}
+		return a.NextAttempt.Compare(b.NextAttempt)
+	})
+	peers := []data.BEPeer{}
+	for _, candidate := range eligible[:min(n, len(eligible))] {
+		candidate.Connecting = true
+		peers = append(peers, candidate.Peer)
+	}
+	return peers
+}
+
+// Connected resets the peer's failure count
+func (c *CandidatePool) Connected(peer *data.BEPeer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if candidate, ok := c.candidates[candidateKey(peer)]; ok {
+		candidate.Failures = 0
+		candidate.GaveUp = false
+	}
+}
+
+// Failed records a failed attempt at connecting to the peer, and gives up
+// on it after MAX_CONNECT_ATTEMPTS of them
+func (c *CandidatePool) Failed(peer *data.BEPeer, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	candidate, ok := c.candidates[candidateKey(peer)]
+	if !ok {
+		return
+	}
+	candidate.Connecting = false
+	candidate.Failures += 1
+	if candidate.Failures >= MAX_CONNECT_ATTEMPTS {
+		candidate.GaveUp = true
+		return
+	}
+	candidate.NextAttempt = now.Add(min(CONNECT_BACKOFF<<(candidate.Failures-1), MAX_CONNECT_BACKOFF))
+}
+
+// Disconnected makes the peer available again once we've been apart for a
+// little while
+func (c *CandidatePool) Disconnected(peer *data.BEPeer, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if candidate, ok := c.candidates[candidateKey(peer)]; ok {
+		candidate.Connecting = false
+		candidate.NextAttempt = now.Add(CONNECT_BACKOFF)
+	}
+}
+
+// Len is the number of peers we haven't given up on
+func (c *CandidatePool) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := 0
+	for _, candidate := range c.candidates {
+		if !candidate.GaveUp {
+			n += 1
+		}
+	}
+	return n
+}
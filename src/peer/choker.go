@@ -0,0 +1,115 @@
+package peer
+
+import (
+	"encoding/hex"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// the standard tit-for-tat timings - peers get re-evaluated every 10s and
+// the optimistic unchoke moves on every 3rd round
+const CHOKE_INTERVAL = 10 * time.Second
+const OPTIMISTIC_UNCHOKE_ROUNDS = 3
+
+const DEFAULT_UPLOAD_SLOTS = 4
+
+// a peer that unchoked us but hasn't sent anything in that long is snubbing
+// us - unless told otherwise, see PeerManager.SnubTimeout
+const SNUB_TIMEOUT = 60 * time.Second
+
+type chokeCandidate struct {
+	key     string
+	rate    float64
+	snubbed bool
+}
+
+// rankPeers returns the peers that deserve one of the regular upload slots -
+// the ones giving us the best rates. Snubbed peers don't qualify, they can
+// only get in via the optimistic unchoke.
+func rankPeers(candidates []chokeCandidate, slots int) []string {
+	eligible := slices.DeleteFunc(slices.Clone(candidates), func(c chokeCandidate) bool {
+		return c.snubbed
+	})
+	slices.SortStableFunc(eligible, func(a, b chokeCandidate) int {
+		if a.rate > b.rate {
+			return -1
+		} else if a.rate < b.rate {
+			return 1
+		}
+		return 0
+	})
+	unchoked := []string{}
+	for _, candidate := range eligible[:min(slots, len(eligible))] {
+		unchoked = append(unchoked, candidate.key)
+	}
+	return unchoked
+}
+
+// Rechoke decides who we upload to. While downloading, we reciprocate with
+// the peers that upload the most to us - once we're seeding, we favour the
+// peers we can upload to the fastest.
+func (p *PeerManager) Rechoke(rotateOptimistic bool) {
+	p.PeerHandlerLock.Lock()
+
+	have := p.Pieces.Have()
+	seeding := have.Count() == have.NumPieces()
+	candidates := []chokeCandidate{}
+	for key, handler := range p.PeerHandlers {
+		if !handler.Status.Ready || !handler.Status.PeerInterested {
+			continue
+		}
+		snubbed := false
+		if !seeding {
+			handler.lock.Lock()
+			snubbed = handler.Snubbed
+			handler.lock.Unlock()
+		}
+		rate := handler.Downloaded.Rate()
+		if seeding {
+			rate = handler.Uploaded.Rate()
+		}
+		candidates = append(candidates, chokeCandidate{key: key, rate: rate, snubbed: snubbed})
+	}
+
+	unchoked := rankPeers(candidates, p.UploadSlots)
+
+	// the optimistic unchoke is how new peers get a chance to show us
+	// what they've got, and how we find better peers than our current ones
+	optimisticStillValid := slices.ContainsFunc(candidates, func(c chokeCandidate) bool {
+		return c.key == p.optimisticPeer
+	}) && !slices.Contains(unchoked, p.optimisticPeer)
+	if rotateOptimistic || !optimisticStillValid {
+		p.optimisticPeer = ""
+		others := slices.DeleteFunc(slices.Clone(candidates), func(c chokeCandidate) bool {
+			return slices.Contains(unchoked, c.key)
+		})
+		if len(others) > 0 {
+			p.optimisticPeer = others[rand.IntN(len(others))].key
+			log.Printf("optimistically unchoking peer %s", hex.EncodeToString([]byte(p.optimisticPeer)))
+		}
+	}
+	if p.optimisticPeer != "" {
+		unchoked = append(unchoked, p.optimisticPeer)
+	}
+
+	changes := map[*PeerHandler]bool{}
+	for key, handler := range p.PeerHandlers {
+		if !handler.Status.Ready {
+			continue
+		}
+		choking := !slices.Contains(unchoked, key)
+		if handler.Status.AmChoking != choking {
+			handler.Status.AmChoking = choking
+			changes[handler] = choking
+		}
+	}
+	p.PeerHandlerLock.Unlock()
+
+	// the handlers may take a moment to get round to it, there's no
+	// point holding everyone else up in the meantime
+	for handler, choking := range changes {
+		handler.SetChoking(choking)
+	}
+}
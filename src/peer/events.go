@@ -0,0 +1,103 @@
+package peer
+
+import "axiomiety/go-bt/data"
+
+// how many events can be waiting on the manager before handlers have to wait
+const EVENT_QUEUE_SIZE = 64
+
+// PeerEvent is how a handler tells its manager what's going on. Handlers
+// own their state - the manager never reads it directly, it builds up its
+// own view of each peer (see PeerStatus) from these.
+type PeerEvent interface {
+	Source() *PeerHandler
+}
+
+// ReadyEvent is sent once the handshake is done
+type ReadyEvent struct {
+	Handler *PeerHandler
+	// as the peer sent it in its handshake, which may not be what the
+	// tracker told us
+	PeerId [20]byte
+}
+
+// BitfieldEvent carries a copy of the bitfield the peer sent us
+type BitfieldEvent struct {
+	Handler  *PeerHandler
+	BitField data.BitField
+}
+
+type HaveEvent struct {
+	Handler *PeerHandler
+	Index   uint32
+}
+
+// BlockEvent is sent for every block we receive - PieceComplete is set when
+// that was the last block missing from its piece
+type BlockEvent struct {
+	Handler       *PeerHandler
+	Ref           BlockRef
+	PieceComplete bool
+	// the other peers we'd asked for the block (in endgame mode), which
+	// should cancel their requests
+	Cancelled []string
+}
+
+// TimeoutEvent is sent when requests to the peer time out - the blocks
+// are up for grabs again
+type TimeoutEvent struct {
+	Handler *PeerHandler
+	Blocks  []BlockRef
+}
+
+// UploadEvent is sent for every block we send the peer
+type UploadEvent struct {
+	Handler *PeerHandler
+	Ref     BlockRef
+}
+
+// ChokeEvent is sent when the peer chokes or unchokes us
+type ChokeEvent struct {
+	Handler *PeerHandler
+	Choked  bool
+}
+
+// InterestEvent is sent when the peer tells us whether it wants anything from us
+type InterestEvent struct {
+	Handler    *PeerHandler
+	Interested bool
+}
+
+// ErrorEvent is the last event a handler sends - the connection is closed
+// and the handler won't do anything else
+type ErrorEvent struct {
+	Handler *PeerHandler
+	Err     error
+}
+
+func (e *ReadyEvent) Source() *PeerHandler    { return e.Handler }
+func (e *BitfieldEvent) Source() *PeerHandler { return e.Handler }
+func (e *HaveEvent) Source() *PeerHandler     { return e.Handler }
+func (e *BlockEvent) Source() *PeerHandler    { return e.Handler }
+func (e *TimeoutEvent) Source() *PeerHandler  { return e.Handler }
+func (e *UploadEvent) Source() *PeerHandler   { return e.Handler }
+func (e *ChokeEvent) Source() *PeerHandler    { return e.Handler }
+func (e *InterestEvent) Source() *PeerHandler { return e.Handler }
+func (e *ErrorEvent) Source() *PeerHandler    { return e.Handler }
+
+// PeerStatus is the manager's view of a peer, put together from the events
+// its handler sends. It's only ever touched with the manager's
+// PeerHandlerLock held.
+type PeerStatus struct {
+	// what the handler is filed under in PeerHandlers - the peer's ID once
+	// we know it, its address until then
+	Key      string
+	Ready    bool
+	BitField data.BitField
+	// whether the peer is choking us, and whether it wants anything from us
+	PeerChoking    bool
+	PeerInterested bool
+	// whether we're choking the peer, as decided by the choker
+	AmChoking bool
+	// which client the peer is running, going by its peer ID
+	Client string
+}
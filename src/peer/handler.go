@@ -1,18 +1,18 @@
 package peer
 
 import (
+	"axiomiety/go-bt/bencode"
 	"axiomiety/go-bt/data"
+	"bytes"
 	"context"
-	"crypto/sha1"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"math"
 	"net"
 	"os"
+	"slices"
 	"sync"
 	"time"
 )
@@ -24,22 +24,37 @@ const (
 	ERROR
 	READY
 	UNCHOKED
-	REQUESTING_PIECE
-	PIECE_COMPLETE
 )
 
-// 2^14-1
-const PIECE_LENGTH = uint32(16383)
+// pieces are requested in blocks of 2^14 bytes - the de facto standard
+const BLOCK_SIZE = uint32(16384)
 
-type PendingPiece struct {
-	TotalSize  uint32
-	Data       []byte
-	NextOffset uint32
-	Index      uint32
-}
+// bounds on the number of requests we keep outstanding with a single peer
+const MIN_QUEUE_DEPTH = 2
+const DEFAULT_MAX_QUEUE_DEPTH = 64
+
+// we want enough requests in flight to keep the peer busy for this long
+// at the rate it's currently sending us data
+const QUEUE_TIME = 3 * time.Second
+
+// the largest block we'll serve - anything bigger and the peer is
+// likely up to no good
+const MAX_REQUEST_LENGTH = 2 * BLOCK_SIZE
+
+// peers typically hang up after 2 minutes of silence, so we make sure to
+// say something before then - and expect the same of them
+const KEEP_ALIVE_INTERVAL = 90 * time.Second
+const READ_TIMEOUT = 2 * time.Minute
+
+// requests that go unanswered for that long get handed to someone else
+const REQUEST_TIMEOUT = 60 * time.Second
+
+// how often we check on the above
+const HOUSEKEEPING_INTERVAL = 5 * time.Second
 
-func (pb *PendingPiece) IsComplete() bool {
-	return pb.NextOffset == pb.TotalSize
+// BlockReader is how handlers get hold of the data peers request from us
+type BlockReader interface {
+	ReadBlock(ref BlockRef) ([]byte, error)
 }
 
 type PeerHandler struct {
@@ -48,84 +63,204 @@ type PeerHandler struct {
 	InfoHash   [20]byte
 	Connection net.Conn
 	State      StateType
-	Incoming   chan *data.Message
-	Outgoing   chan *data.Message
-	BitField   data.BitField
-	PendingPiece
+	Incoming   chan data.PeerMessage
+	// blocks we upload - see queue for everything else
+	Outgoing chan *data.Message
+	// messages waiting for the Loop to send them
+	outbox       []*data.Message
+	outboxLock   sync.Mutex
+	outboxSignal chan struct{}
+	BitField     data.BitField
+	// our own cap on outstanding requests, and the peer's (BEP 10 reqq)
+	MaxQueueDepth int
+	PeerReqq      int
+	// how many requests we currently aim to keep outstanding
+	QueueDepth         int
+	Downloaded         RateMeter
+	SupportsExtensions bool
+	// what the peer sent in its handshake
+	remotePeerId [20]byte
+	// shared with the other handlers of the same torrent
+	Pieces *PieceTracker
+	// whether we've told the peer it has something we want
+	AmInterested bool
+	// requests sent but not yet answered
+	Outstanding map[BlockRef]time.Time
+	lock        sync.Mutex
+	// the upload side of things - whether we're choking the peer, whether
+	// it wants anything from us, and what it asked for
+	AmChoking      bool
+	PeerInterested bool
+	PeerRequests   []BlockRef
+	Uploaded       RateMeter
+	Storage        BlockReader
+	uploadSignal   chan struct{}
+	// so we can tell when a peer is snubbing us
+	UnchokedAt     time.Time
+	LastBlockAt    time.Time
+	Snubbed        bool
+	SnubTimeout    time.Duration
+	RequestTimeout time.Duration
+	// every limiter the connection's traffic counts against - typically
+	// the global one and the torrent's
+	DownloadLimiters []*RateLimiter
+	UploadLimiters   []*RateLimiter
+	// where we report what's going on to the manager - can be nil
+	Events chan<- PeerEvent
+	// the manager's view of the peer, which is the manager's to update
+	Status PeerStatus
+	// closed when the handler fails, which brings the Loop to an end
+	failed   chan struct{}
+	failOnce sync.Once
+	err      error
+	// closed once the Loop is done, so nothing waits on it forever
+	done chan struct{}
+	// cancels the context the handler was started with
+	cancel context.CancelFunc
 }
 
-func MakePeerHandler(peer *data.BEPeer, peerId [20]byte, infoHash [20]byte, blockSize uint32) *PeerHandler {
+func MakePeerHandler(peer *data.BEPeer, peerId [20]byte, infoHash [20]byte, numPieces uint32) *PeerHandler {
 	return &PeerHandler{
 		Peer:       peer,
 		PeerId:     peerId,
 		InfoHash:   infoHash,
 		Connection: nil,
 		State:      UNSET,
-		Incoming:   make(chan *data.Message),
+		Incoming:   make(chan data.PeerMessage),
 		Outgoing:   make(chan *data.Message),
-		BitField: data.BitField{
-			Field: make([]byte, blockSize/20),
-		},
+		BitField:   data.NewBitField(numPieces),
+		// this gets adjusted as we measure how fast the peer is
+		MaxQueueDepth: DEFAULT_MAX_QUEUE_DEPTH,
+		QueueDepth:    MIN_QUEUE_DEPTH,
+		Outstanding:   map[BlockRef]time.Time{},
+		// everyone starts off choked
+		AmChoking:      true,
+		SnubTimeout:    SNUB_TIMEOUT,
+		RequestTimeout: REQUEST_TIMEOUT,
+		uploadSignal:   make(chan struct{}, 1),
+		outboxSignal:   make(chan struct{}, 1),
+		failed:         make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+}
+
+// fail brings the handler to a halt - only the first error sticks. This
+// doesn't take the lock, whoever holds it may be waiting on the Loop.
+func (p *PeerHandler) fail(err error) {
+	p.failOnce.Do(func() {
+		p.err = err
+		close(p.failed)
+	})
+}
+
+func (p *PeerHandler) failure() error {
+	select {
+	case <-p.failed:
+		return p.err
+	default:
+		return nil
 	}
 }
 
-func (p *PeerHandler) Connect() {
+// emit reports an event to the manager. This must never be called with the
+// handler's lock held, the manager may be waiting on it.
+func (p *PeerHandler) emit(event PeerEvent) {
+	if p.Events == nil {
+		return
+	}
+	select {
+	case p.Events <- event:
+	case <-p.done:
+	}
+}
+
+// queue hands a message over to the Loop to be sent. It never waits on
+// the Loop, which may be stuck writing to a slow peer - the manager calls
+// this for every peer from its own loop, and callers may hold the
+// handler's lock.
+func (p *PeerHandler) queue(msg *data.Message) {
+	p.outboxLock.Lock()
+	p.outbox = append(p.outbox, msg)
+	p.outboxLock.Unlock()
+	select {
+	case p.outboxSignal <- struct{}{}:
+	default:
+	}
+}
+
+// takeQueued empties the outbox
+func (p *PeerHandler) takeQueued() []*data.Message {
+	p.outboxLock.Lock()
+	defer p.outboxLock.Unlock()
+	msgs := p.outbox
+	p.outbox = nil
+	return msgs
+}
+
+func (p *PeerHandler) Connect() error {
 	address := net.JoinHostPort(p.Peer.IP, fmt.Sprintf("%d", p.Peer.Port))
 	conn, err := net.DialTimeout("tcp", address, time.Second*5)
 	if err != nil {
 		log.Printf("error connecting to peer %s: %s", hex.EncodeToString([]byte(p.Peer.Id)), err)
-		p.State = ERROR
-		return
+		p.fail(err)
+		return err
 	}
-	p.Connection = conn
+	p.Connection = p.limit(conn)
 	log.Printf("connected to %s", address)
+	return nil
+}
+
+func (p *PeerHandler) limit(conn net.Conn) net.Conn {
+	if len(p.DownloadLimiters) == 0 && len(p.UploadLimiters) == 0 {
+		return conn
+	}
+	return &RateLimitedConn{
+		Conn:          conn,
+		ReadLimiters:  p.DownloadLimiters,
+		WriteLimiters: p.UploadLimiters,
+	}
+}
+
+func (p *PeerHandler) sendHandshake() {
+	handshakeMsg := data.GetHanshake(p.PeerId, p.InfoHash)
+	// we only use the extension protocol to find out the peer's reqq
+	handshakeMsg.Reserved[5] |= data.ExtensionProtocolBit
+	_, err := p.Connection.Write(handshakeMsg.ToBytes())
+	if err != nil {
+		p.fail(fmt.Errorf("unable to send handshake: %w", err))
+	}
 }
 
-func (p *PeerHandler) Handshake() {
+func (p *PeerHandler) Handshake() error {
 	// a handshake consists of both sending and receiving one!
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		handshakeMsg := data.GetHanshake(p.PeerId, p.InfoHash)
-		// fmt.Printf("%+v", handshakeMsg)
-		numBytesWritten, err := p.Connection.Write(handshakeMsg.ToBytes())
-		if err != nil || numBytesWritten == 0 {
-			p.State = ERROR
-		}
+		p.sendHandshake()
 	}()
 
 	go func() {
 		defer wg.Done()
-		buf := make([]byte, 1)
 		// it really shouldn't take the peer that long to get back with
 		// a handshake - if it does, we're probably not getting anything from them
 		p.Connection.SetReadDeadline(time.Now().Add(5 * time.Second))
-		numBytesRead, err := io.ReadFull(p.Connection, buf)
-		if err != nil && err != io.EOF || numBytesRead == 0 {
-			log.Printf("handshake error (pstrlen): %s", err)
-			p.State = ERROR
-			return
-		}
-		pstrLength := buf[0]
-		buf = make([]byte, 49+pstrLength-1)
-		numBytesRead, err = p.Connection.Read(buf)
-		if err != nil && err != io.EOF || numBytesRead == 0 {
+		peerHandShake, err := data.ReadHandshake(p.Connection)
+		if err != nil {
 			log.Printf("handshake error: %s", err)
-			p.State = ERROR
+			p.fail(err)
 			return
 		}
-		peerHandShake := data.Handshake{
-			PstrLen:  pstrLength,
-			Pstr:     buf[1:pstrLength],
-			Reserved: [8]byte(buf[pstrLength : pstrLength+8]),
-			InfoHash: [20]byte(buf[pstrLength+8 : pstrLength+8+20]),
-			PeerId:   [20]byte(buf[pstrLength+8+20:]),
-		}
+		p.SupportsExtensions = peerHandShake.SupportsExtensions()
+		p.remotePeerId = peerHandShake.PeerId
 		// validate it all matches
 		if peerHandShake.InfoHash != p.InfoHash {
 			log.Printf("info_hash doesn't match!")
-			p.State = ERROR
+			p.fail(errors.New("info_hash doesn't match"))
+		}
+		// trackers can send us our own address
+		if peerHandShake.PeerId == p.PeerId {
+			p.fail(errors.New("connected to ourselves"))
 		}
 		// peer spoofing?
 		// if string(peerHandShake.PeerId[:]) != p.Peer.Id {
@@ -134,193 +269,599 @@ func (p *PeerHandler) Handshake() {
 		// }
 	}()
 	wg.Wait()
-	// if we reach here, we're ready!
-	if p.State != ERROR {
-		p.State = READY
+	return p.ready()
+}
+
+// ready moves the handler on to READY unless the handshake failed
+func (p *PeerHandler) ready() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.failure(); err != nil {
+		p.State = ERROR
+		return err
 	}
+	p.State = READY
+	return nil
 }
 
-func getMessage(conn net.Conn) (*data.Message, error) {
+// Accept hands the handler a connection the peer initiated - the listener
+// has already read and checked its handshake, ours goes out once the Loop
+// starts
+func (p *PeerHandler) Accept(conn net.Conn, peerHandshake *data.Handshake) {
+	p.Connection = p.limit(conn)
+	p.SupportsExtensions = peerHandshake.SupportsExtensions()
+	p.remotePeerId = peerHandshake.PeerId
+}
+
+// the largest message we'll accept is either a block or our bitfield,
+// whichever is bigger - with a bit of leeway for peers sending larger blocks
+func maxMessageLength(numPieces uint32) uint32 {
+	return max(2*BLOCK_SIZE+9, (numPieces+7)/8+1)
+}
 
-	timeoutWaitDuration := 2 * time.Minute
-	conn.SetReadDeadline(time.Now().Add(timeoutWaitDuration))
-	header := make([]byte, 4)
-	numBytesRead, err := io.ReadFull(conn, header)
+func (p *PeerHandler) getMessage(maxLength uint32) (data.PeerMessage, error) {
+	p.Connection.SetReadDeadline(time.Now().Add(READ_TIMEOUT))
+	msg, err := data.ReadMessage(p.Connection, maxLength)
+	if os.IsTimeout(err) {
+		log.Println("timed out reading length header from client")
+	}
+	return msg, err
+}
 
-	processBadResponse := func(err error, numBytesRead int) (*data.Message, error) {
-		if numBytesRead == 0 {
-			log.Printf("no data!")
-			return &data.Message{}, errors.New("no data")
-		} else if os.IsTimeout(err) {
-			log.Println("timed out reading length header from client")
-			return &data.Message{}, err
-		} else {
-			return &data.Message{}, err
+// Listen reads messages off the connection until it errors, which is also
+// what happens when the Loop closes it on the way out
+func (p *PeerHandler) Listen(ctx context.Context) {
+	maxLength := maxMessageLength(p.BitField.Size)
+	for {
+		msg, err := p.getMessage(maxLength)
+		if err != nil {
+			log.Printf("error reading from peer: %s", err)
+			p.fail(err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.done:
+			return
+		case p.Incoming <- msg:
 		}
 	}
+}
 
-	if (err != nil && err != io.EOF) || numBytesRead == 0 {
-		return processBadResponse(err, numBytesRead)
+// the key the manager (and the piece tracker) know a peer by - peers from
+// compact tracker responses don't come with an ID, so we go by their
+// address instead
+func peerKey(peer *data.BEPeer) string {
+	if peer.Id != "" {
+		return peer.Id
 	}
+	return candidateKey(peer)
+}
 
-	length := binary.BigEndian.Uint32(header[:])
+func (p *PeerHandler) key() string {
+	return peerKey(p.Peer)
+}
 
-	// keep-alive
-	if length == 0 {
-		return &data.Message{}, nil
+// RequestBlocks tops up our request queue with blocks from the piece
+// tracker and returns the number of new requests sent
+func (p *PeerHandler) RequestBlocks() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sendCancels()
+	if p.State != UNCHOKED {
+		return 0
 	}
+	return p.fillRequestQueue()
+}
 
-	buffer := make([]byte, length)
-	numBytesRead, err = io.ReadFull(conn, buffer)
-	if (err != nil && err != io.EOF) || numBytesRead == 0 {
-		return processBadResponse(err, numBytesRead)
+// sendCancels cancels the requests another peer beat this one to (which
+// only happens in endgame mode). The caller must hold the handler's lock.
+func (p *PeerHandler) sendCancels() {
+	if p.Pieces == nil {
+		return
 	}
-
-	msg := &data.Message{
-		Length:    [4]byte(header),
-		MessageId: buffer[0],
+	for _, ref := range p.Pieces.TakeCancels(p.key()) {
+		if _, outstanding := p.Outstanding[ref]; outstanding {
+			delete(p.Outstanding, ref)
+			p.queue(data.Cancel(ref.Index, ref.Begin, ref.Length))
+		}
 	}
+}
 
-	// some messages don't have a payload
-	if len(buffer) > 1 {
-		msg.Payload = buffer[1:]
+// isSnubbed is true if the peer unchoked us but hasn't sent us anything
+// we asked for in a while. The caller must hold the handler's lock.
+func (p *PeerHandler) isSnubbed(now time.Time) bool {
+	if p.State != UNCHOKED || len(p.Outstanding) == 0 {
+		return false
 	}
-
-	return msg, nil
+	lastActivity := p.UnchokedAt
+	if p.LastBlockAt.After(lastActivity) {
+		lastActivity = p.LastBlockAt
+	}
+	return now.Sub(lastActivity) > p.SnubTimeout
 }
 
-func (p *PeerHandler) Listen(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("shutting down listener")
-		default:
-			msg, err := getMessage(p.Connection)
-			if err != nil {
-				log.Printf("error: %s", err)
-				break
-			}
-			p.Incoming <- msg
+// housekeeping hands back the requests the peer is taking too long to
+// answer, so other peers can have a go (but not this one), and keeps an
+// eye out for peers snubbing us. It returns the blocks that timed out. The caller must hold
+// the handler's lock.
+func (p *PeerHandler) housekeeping(now time.Time) []BlockRef {
+	if !p.Snubbed && p.isSnubbed(now) {
+		log.Printf("peer %s is snubbing us", hex.EncodeToString([]byte(p.Peer.Id)))
+		p.Snubbed = true
+		// no point queueing up more than the bare minimum with it
+		p.QueueDepth = MIN_QUEUE_DEPTH
+	}
+	expired := []BlockRef{}
+	for ref, requestedAt := range p.Outstanding {
+		if now.Sub(requestedAt) > p.RequestTimeout {
+			expired = append(expired, ref)
+			delete(p.Outstanding, ref)
 		}
 	}
+	if len(expired) > 0 && p.Pieces != nil {
+		log.Printf("%d request(s) to %s timed out", len(expired), hex.EncodeToString([]byte(p.Peer.Id)))
+		p.Pieces.TimeOutBlocks(p.key(), expired...)
+	}
+	return expired
+}
+
+// the peer's reqq is only a hint but going over it can get us disconnected
+func (p *PeerHandler) maxQueueDepth() int {
+	if p.PeerReqq > 0 {
+		return min(p.MaxQueueDepth, p.PeerReqq)
+	}
+	return p.MaxQueueDepth
 }
 
-func (p *PeerHandler) RequestPiece(idx uint32, pieceLength uint32) {
-	log.Printf("requesting piece %d from peer", idx)
+// queueDepth returns how many blocks we need outstanding to keep a peer
+// sending us data at the given rate (in bytes/s) busy for QUEUE_TIME
+func queueDepth(rate float64, maxDepth int) int {
+	depth := int(math.Ceil(rate * QUEUE_TIME.Seconds() / float64(BLOCK_SIZE)))
+	return max(MIN_QUEUE_DEPTH, min(depth, maxDepth))
+}
+
+// fillRequestQueue asks the piece tracker for enough blocks to bring the
+// number of outstanding requests up to the queue depth. The caller must
+// hold the handler's lock.
+func (p *PeerHandler) fillRequestQueue() int {
+	numToRequest := p.QueueDepth - len(p.Outstanding)
+	if numToRequest <= 0 || p.Pieces == nil {
+		return 0
+	}
+	blocks := p.Pieces.NextBlocks(p.key(), &p.BitField, numToRequest)
+	for _, block := range blocks {
+		p.Outstanding[block] = time.Now()
+		p.queue(data.Request(block.Index, block.Begin, block.Length))
+	}
+	return len(blocks)
+}
 
-	// so we don't request a new piece until we're back to a READY state
-	p.State = REQUESTING_PIECE
-	p.PendingPiece = PendingPiece{
-		// could we get this from the slice's capacity?
-		TotalSize: pieceLength,
-		Index:     idx,
+// releaseBlocks hands our outstanding requests back to the piece tracker
+// so other peers can pick them up. The caller must hold the handler's lock.
+func (p *PeerHandler) releaseBlocks() {
+	if p.Pieces != nil && len(p.Outstanding) > 0 {
+		refs := make([]BlockRef, 0, len(p.Outstanding))
+		for ref := range p.Outstanding {
+			refs = append(refs, ref)
+		}
+		p.Pieces.ReleaseBlocks(p.key(), refs...)
 	}
-	// can't set it above otherwise when it gets copied, the capacity is zero!
-	p.Data = make([]byte, p.TotalSize)
-	// the first packet is tricky!
-	amountOfDataToRequest := min(p.TotalSize, PIECE_LENGTH)
-	p.Outgoing <- data.Request(idx, 0, amountOfDataToRequest)
+	clear(p.Outstanding)
 }
 
 func (p *PeerHandler) send(data []byte) {
 	bytesWritten, err := p.Connection.Write(data)
 	if err != nil {
 		log.Printf("error writing to peer! %s", err)
-	}
-	if bytesWritten != len(data) {
-		log.Printf("only wrote %d bytes for a message %d bytes long", bytesWritten, len(data))
-		p.State = ERROR
+		p.fail(err)
+		return
 	}
 	log.Printf("send %d bytes to peer", bytesWritten)
 }
 
-func (p *PeerHandler) receiveBlock(payload []byte) {
-	// extract the relevant information
-	index := binary.BigEndian.Uint32(payload[:4])
-	begin := binary.BigEndian.Uint32(payload[4:8])
-	// 4 bytes for the index, 4 bytes for the offset
-	blockLength := len(payload) - 8
-	log.Printf("received block for index %d from %d with length %d", index, begin, blockLength)
-
-	// copy the data into our piece buffer
-	copy(p.PendingPiece.Data[begin:begin+uint32(blockLength)], payload[8:])
-	p.PendingPiece.NextOffset = begin + uint32(blockLength)
-
-	if p.PendingPiece.IsComplete() {
-		log.Printf("piece %d is complete", p.PendingPiece.Index)
-		// sha1 validation!
-		h := sha1.New()
-		h.Write(p.PendingPiece.Data)
-		log.Printf("hash: %s", hex.EncodeToString(h.Sum(nil)))
-		p.State = PIECE_COMPLETE
-	} else if p.PendingPiece.NextOffset < p.PendingPiece.TotalSize {
-		// we need to request another piece
-		// at most we'll get 16KB
-		pieceLength := min(uint32(math.Pow(2, 14)), p.PendingPiece.TotalSize-p.PendingPiece.NextOffset)
-		msg := data.Request(p.PendingPiece.Index, p.PendingPiece.NextOffset, pieceLength)
-		p.Outgoing <- msg
-	} else {
-		log.Printf("downloaded more than we should have! next:%d vs total:%d resetting...", p.PendingPiece.NextOffset, p.PendingPiece.TotalSize)
-		p.State = READY
+// receiveBlock returns true if the block completed its piece, along with
+// the other peers whose requests for it need cancelling
+func (p *PeerHandler) receiveBlock(msg *data.PieceMessage) (bool, []string) {
+	ref := BlockRef{
+		Index:  msg.Index,
+		Begin:  msg.Begin,
+		Length: uint32(len(msg.Block)),
+	}
+	log.Printf("received block for index %d from %d with length %d", ref.Index, ref.Begin, ref.Length)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, requested := p.Outstanding[ref]; !requested {
+		// this can happen if we were choked and then unchoked, or the request
+		// timed out - it's up to the tracker whether it still wants it
+		log.Printf("received block %+v which isn't outstanding", ref)
 	}
+	delete(p.Outstanding, ref)
+	p.LastBlockAt = time.Now()
+	p.Snubbed = false
+	p.Downloaded.Add(len(msg.Block))
+	p.QueueDepth = queueDepth(p.Downloaded.Rate(), p.maxQueueDepth())
+
+	if p.Pieces == nil {
+		return false, nil
+	}
+	complete, cancelled := p.Pieces.ReceiveBlock(p.key(), ref, msg.Block)
+	if complete {
+		log.Printf("piece %d is complete", ref.Index)
+	}
+	p.sendCancels()
+	if p.State == UNCHOKED {
+		p.fillRequestQueue()
+	}
+	return complete, cancelled
 }
 
-func (p *PeerHandler) processIncoming(msg *data.Message) {
+func (p *PeerHandler) extendedHandshake() *data.Message {
+	buffer := &bytes.Buffer{}
+	bencode.Encode(buffer, map[string]any{
+		// we don't support any extended messages
+		"m":    map[string]any{},
+		"reqq": p.MaxQueueDepth,
+		"v":    "go-bt",
+	})
+	return data.Extended(0, buffer.Bytes())
+}
 
-	switch msg.MessageId {
-	case data.MsgChoke:
+func (p *PeerHandler) processExtendedHandshake(payload []byte) {
+	// the bencode parser panics on malformed input, and we can't trust peers
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("unable to parse extended handshake: %v", r)
+		}
+	}()
+	dict, ok := bencode.ParseBencoded2(bytes.NewReader(payload)).(map[string]any)
+	if !ok {
+		log.Printf("extended handshake isn't a dictionary")
+		return
+	}
+	if reqq, ok := dict["reqq"].(int); ok && reqq > 0 {
+		log.Printf("peer accepts up to %d outstanding requests", reqq)
+		p.lock.Lock()
+		p.PeerReqq = reqq
+		p.lock.Unlock()
+	}
+}
+
+func (p *PeerHandler) processIncoming(msg data.PeerMessage) {
+
+	switch msg := msg.(type) {
+	case *data.KeepAliveMessage:
+		// nothing to do, the read deadline has already been pushed back
+	case *data.ChokeMessage:
 		log.Print("we're choked!")
+		p.lock.Lock()
+		// the peer discards any requests it hasn't served yet
+		p.releaseBlocks()
 		p.State = READY
-	case data.MsgBitfield:
-		p.BitField = data.BitField{
-			Field: msg.Payload,
+		p.Snubbed = false
+		p.lock.Unlock()
+		p.emit(&ChokeEvent{Handler: p, Choked: true})
+	case *data.BitfieldMessage:
+		if err := msg.BitField.Validate(p.BitField.Size); err != nil {
+			log.Printf("bad bitfield from peer: %s", err)
+			p.fail(err)
+			return
+		}
+		msg.BitField.Size = p.BitField.Size
+		p.lock.Lock()
+		p.BitField = msg.BitField
+		p.updateInterest()
+		if p.State == UNCHOKED {
+			p.fillRequestQueue()
+		}
+		p.lock.Unlock()
+		// the handler's copy keeps changing as the peer gets new pieces
+		bitField := data.BitField{Field: slices.Clone(msg.BitField.Field), Size: msg.BitField.Size}
+		p.emit(&BitfieldEvent{Handler: p, BitField: bitField})
+	case *data.HaveMessage:
+		if msg.Index >= p.BitField.Size {
+			p.fail(fmt.Errorf("peer has piece %d out of %d", msg.Index, p.BitField.Size))
+			return
+		}
+		p.lock.Lock()
+		p.BitField.SetPiece(msg.Index)
+		p.updateInterest()
+		if p.State == UNCHOKED {
+			p.fillRequestQueue()
 		}
-	case data.MsgPiece:
-		p.receiveBlock(msg.Payload)
-	case data.MsgUnchoke:
+		p.lock.Unlock()
+		p.emit(&HaveEvent{Handler: p, Index: msg.Index})
+	case *data.PieceMessage:
+		complete, cancelled := p.receiveBlock(msg)
+		ref := BlockRef{Index: msg.Index, Begin: msg.Begin, Length: uint32(len(msg.Block))}
+		p.emit(&BlockEvent{Handler: p, Ref: ref, PieceComplete: complete, Cancelled: cancelled})
+	case *data.ExtendedMessage:
+		if msg.ExtendedId == 0 {
+			p.processExtendedHandshake(msg.Payload)
+		}
+	case *data.UnchokeMessage:
 		log.Printf("unchocked!")
+		p.lock.Lock()
 		p.State = UNCHOKED
+		p.UnchokedAt = time.Now()
+		p.fillRequestQueue()
+		p.lock.Unlock()
+		p.emit(&ChokeEvent{Handler: p, Choked: false})
+	case *data.InterestedMessage:
+		// whether we unchoke the peer is up to the manager's choker
+		p.lock.Lock()
+		p.PeerInterested = true
+		p.lock.Unlock()
+		p.emit(&InterestEvent{Handler: p, Interested: true})
+	case *data.NotInterestedMessage:
+		p.lock.Lock()
+		p.PeerInterested = false
+		p.lock.Unlock()
+		p.emit(&InterestEvent{Handler: p, Interested: false})
+	case *data.RequestMessage:
+		p.queueRequest(BlockRef{Index: msg.Index, Begin: msg.Begin, Length: msg.Length})
+	case *data.CancelMessage:
+		p.cancelRequest(BlockRef{Index: msg.Index, Begin: msg.Begin, Length: msg.Length})
 	default:
 		log.Printf("don't know what to do with this message!")
 	}
 }
 
-func (p *PeerHandler) Interested() {
-	length := make([]byte, 4)
-	binary.BigEndian.PutUint32(length, 1)
-	msg := &data.Message{
-		Length:    [4]byte(length),
-		MessageId: data.MsgInterested,
+// updateInterest lets the peer know if it went from having something we
+// want to not having anything, or vice versa. The caller must hold the
+// handler's lock.
+func (p *PeerHandler) updateInterest() {
+	if p.Pieces == nil {
+		return
+	}
+	have := p.Pieces.Have()
+	interested := false
+	for idx := range p.BitField.NumPieces() {
+		if p.BitField.HasPiece(idx) && !have.HasPiece(idx) {
+			interested = true
+			break
+		}
+	}
+	if interested == p.AmInterested {
+		return
+	}
+	p.AmInterested = interested
+	if interested {
+		p.queue(data.Interested())
+	} else {
+		p.queue(data.NotInterested())
 	}
-	p.Outgoing <- msg
 }
 
-func (p *PeerHandler) Loop(ctx context.Context) {
-	p.Connect()
-	if p.State == ERROR {
+// Have tells the peer we've got a new piece - which may well have been
+// the last one it had that we wanted
+func (p *PeerHandler) Have(idx uint32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.queue(data.Have(idx))
+	p.updateInterest()
+}
+
+// SetChoking chokes or unchokes the peer - choking discards whatever the
+// peer has asked us for that we haven't sent yet
+func (p *PeerHandler) SetChoking(choking bool) {
+	p.lock.Lock()
+	if p.AmChoking == choking {
+		p.lock.Unlock()
 		return
 	}
-	defer p.Connection.Close()
-	p.Handshake()
-	if p.State == ERROR {
+	p.AmChoking = choking
+	if choking {
+		p.PeerRequests = nil
+	}
+	p.lock.Unlock()
+
+	if choking {
+		p.queue(data.Choke())
+	} else {
+		p.queue(data.Unchoke())
+	}
+}
+
+func (p *PeerHandler) queueRequest(ref BlockRef) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.AmChoking {
+		log.Printf("ignoring request for %+v from a choked peer", ref)
+		return
+	}
+	if ref.Length == 0 || ref.Length > MAX_REQUEST_LENGTH {
+		log.Printf("ignoring request for %+v with an invalid length", ref)
+		return
+	}
+	// that's what we told the peer via reqq
+	if len(p.PeerRequests) >= p.MaxQueueDepth {
+		log.Printf("ignoring request for %+v as the peer has too many outstanding", ref)
+		return
+	}
+	p.PeerRequests = append(p.PeerRequests, ref)
+	select {
+	case p.uploadSignal <- struct{}{}:
+	default:
+		// the uploader has already been told there's work to do
+	}
+}
+
+func (p *PeerHandler) cancelRequest(ref BlockRef) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.PeerRequests = slices.DeleteFunc(p.PeerRequests, func(request BlockRef) bool {
+		return request == ref
+	})
+}
+
+func (p *PeerHandler) nextRequest() (BlockRef, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.PeerRequests) == 0 {
+		return BlockRef{}, false
+	}
+	ref := p.PeerRequests[0]
+	p.PeerRequests = p.PeerRequests[1:]
+	return ref, true
+}
+
+// upload serves the peer's requests one at a time, so that a cancel
+// can still catch the ones we haven't got round to
+func (p *PeerHandler) upload(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.done:
+			return
+		case <-p.uploadSignal:
+		}
+		for ref, ok := p.nextRequest(); ok; ref, ok = p.nextRequest() {
+			if p.Storage == nil {
+				break
+			}
+			block, err := p.Storage.ReadBlock(ref)
+			if err != nil {
+				log.Printf("unable to serve %+v: %s", ref, err)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.done:
+				return
+			case p.Outgoing <- data.Piece(ref.Index, ref.Begin, block):
+				p.Uploaded.Add(len(block))
+				p.emit(&UploadEvent{Handler: p, Ref: ref})
+			}
+		}
+	}
+}
+
+// processMessages handles incoming messages in the order they arrived -
+// it matters for e.g. an interested message followed by requests
+func (p *PeerHandler) processMessages(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.failed:
+			return
+		case msg := <-p.Incoming:
+			log.Printf("msg received: %T", msg)
+			p.processIncoming(msg)
+		}
+	}
+}
+
+// Start runs the handler in the background with a context of its own, so
+// it can be stopped with Close without affecting anyone else
+func (p *PeerHandler) Start(ctx context.Context) {
+	ctx, p.cancel = context.WithCancel(ctx)
+	go p.Loop(ctx)
+}
+
+// Close stops a handler that was started with Start - the Loop closes the
+// connection and everything else the handler was running on the way out
+func (p *PeerHandler) Close() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+}
+
+// Loop runs the handler until either the context is cancelled or something
+// goes wrong with the peer. Everything it has to say goes to the manager as
+// events, the last of which is always an ErrorEvent.
+func (p *PeerHandler) Loop(ctx context.Context) {
+	if p.Connection == nil {
+		if p.Connect() == nil {
+			p.Handshake()
+		}
+	} else {
+		// the peer came to us, and we already have its handshake
+		p.sendHandshake()
+		p.ready()
+	}
+	defer p.shutdown(ctx)
+	if p.failure() != nil {
 		return
 	}
 	log.Printf("lock 'n load!")
+	p.emit(&ReadyEvent{Handler: p, PeerId: p.remotePeerId})
 	go p.Listen(ctx)
+	go p.processMessages(ctx)
+	go p.upload(ctx)
+	// the bitfield has to be the first message after the handshake, and
+	// can be skipped altogether if we don't have anything
+	if p.Pieces != nil {
+		if have := p.Pieces.Have(); have.Count() > 0 {
+			p.send(data.Bitfield(&have).ToBytes())
+		}
+	}
+	if p.SupportsExtensions {
+		p.send(p.extendedHandshake().ToBytes())
+	}
+	lastSent := time.Now()
+	housekeeping := time.NewTicker(HOUSEKEEPING_INTERVAL)
+	defer housekeeping.Stop()
 
-	// TODO: check our internal state after each message!
 	for {
 		select {
 		case <-ctx.Done():
 			log.Printf("Context is done, closing connection to %s", hex.EncodeToString([]byte(p.Peer.Id)))
-			p.Connection.Close()
 			return
-		case msg := <-p.Incoming:
-			log.Printf("msg received: %x", msg.MessageId)
-			go p.processIncoming(msg)
+		case <-p.failed:
+			log.Printf("closing connection to %s: %s", hex.EncodeToString([]byte(p.Peer.Id)), p.failure())
+			return
+		case <-p.outboxSignal:
+			for _, msg := range p.takeQueued() {
+				log.Printf("msg to send: %x", msg.MessageId)
+				p.send(msg.ToBytes())
+			}
+			lastSent = time.Now()
 		case msg := <-p.Outgoing:
 			log.Printf("msg to send: %x", msg.MessageId)
 			p.send(msg.ToBytes())
+			lastSent = time.Now()
+		case now := <-housekeeping.C:
+			if now.Sub(lastSent) > KEEP_ALIVE_INTERVAL {
+				p.send(data.KeepAlive().ToBytes())
+				lastSent = now
+			}
+			p.lock.Lock()
+			expired := p.housekeeping(now)
+			p.lock.Unlock()
+			// the manager gets other peers to pick up whatever timed out
+			if len(expired) > 0 {
+				p.emit(&TimeoutEvent{Handler: p, Blocks: expired})
+			}
+		}
+	}
+}
+
+// shutdown tears down whatever Loop set up and lets the manager know
+// we're done
+func (p *PeerHandler) shutdown(ctx context.Context) {
+	// anyone still trying to get through to the Loop gives up from here on
+	close(p.done)
+	if p.Connection != nil {
+		p.Connection.Close()
+	}
+	// this does nothing if we're leaving because of an error
+	p.fail(ctx.Err())
+	p.lock.Lock()
+	p.State = ERROR
+	// whatever we haven't received by the time we leave is up for grabs
+	p.releaseBlocks()
+	p.lock.Unlock()
+	err := p.failure()
+	if p.Events != nil {
+		select {
+		case p.Events <- &ErrorEvent{Handler: p, Err: err}:
+		case <-ctx.Done():
 		}
 	}
 }
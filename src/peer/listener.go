@@ -0,0 +1,161 @@
+package peer
+
+import (
+	"axiomiety/go-bt/data"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the port we listen on unless told otherwise
+const DEFAULT_LISTEN_PORT = 6688
+
+// Listener accepts connections from peers and hands them over to the
+// manager of the torrent they're after. A single listener can serve
+// several torrents.
+type Listener struct {
+	// empty to listen on every interface
+	Host string
+	// once Listen returns, the port we ended up on
+	Port int
+	// if set, ports up to this one are tried in turn when Port is taken
+	LastPort int
+	managers map[[20]byte]*PeerManager
+	lock     sync.Mutex
+	listener net.Listener
+}
+
+func NewListener(port int) *Listener {
+	return &Listener{
+		Port:     port,
+		managers: map[[20]byte]*PeerManager{},
+	}
+}
+
+func (l *Listener) Register(m *PeerManager) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.managers[m.InfoHash] = m
+}
+
+func (l *Listener) Unregister(m *PeerManager) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.managers, m.InfoHash)
+}
+
+// Addr is only valid once Listen has returned successfully
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Listen binds to the first port that's free and accepts connections in
+// the background until the context is cancelled
+func (l *Listener) Listen(ctx context.Context) error {
+	var listener net.Listener
+	var err error
+	for port := l.Port; port <= max(l.Port, l.LastPort); port++ {
+		listener, err = net.Listen("tcp", net.JoinHostPort(l.Host, strconv.Itoa(port)))
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			break
+		}
+		log.Printf("port %d is taken", port)
+	}
+	if err != nil {
+		return err
+	}
+	l.listener = listener
+	l.Port = listener.Addr().(*net.TCPAddr).Port
+	log.Printf("listening for peers on %s", listener.Addr())
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go l.accept()
+	return nil
+}
+
+// ParsePortRange parses either a single port or a range like 6881-6889
+func ParsePortRange(ports string) (int, int, error) {
+	first, last, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		last = first
+	}
+	from, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", first)
+	}
+	to, err := strconv.ParseUint(last, 10, 16)
+	if err != nil || to < from {
+		return 0, 0, fmt.Errorf("invalid port range %q", ports)
+	}
+	return int(from), int(to), nil
+}
+
+// localIPs are the addresses of our network interfaces, which is what
+// we'd be dialling if a tracker sent us ourselves back
+var localIPs = sync.OnceValue(func() map[string]bool {
+	ips := map[string]bool{}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("unable to list our addresses: %s", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips[ipNet.IP.String()] = true
+		}
+	}
+	return ips
+})
+
+func isLocalIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	return parsed.IsLoopback() || parsed.IsUnspecified() || localIPs()[parsed.String()]
+}
+
+func (l *Listener) accept() {
+	for {
+		conn, err := l.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			log.Printf("no longer listening for peers")
+			return
+		} else if err != nil {
+			// e.g. we've run out of file descriptors - give it a moment
+			log.Printf("error accepting connection: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go l.handleConnection(conn)
+	}
+}
+
+func (l *Listener) handleConnection(conn net.Conn) {
+	// we can't tell which torrent the peer is after until we have its handshake
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	handshake, err := data.ReadHandshake(conn)
+	if err != nil {
+		log.Printf("handshake error from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	l.lock.Lock()
+	manager, ok := l.managers[handshake.InfoHash]
+	l.lock.Unlock()
+	if !ok {
+		log.Printf("%s asked for unknown info_hash %s", conn.RemoteAddr(), hex.EncodeToString(handshake.InfoHash[:]))
+		conn.Close()
+		return
+	}
+	manager.AddIncomingPeer(conn, handshake)
+}
@@ -2,21 +2,21 @@ package peer
 
 import (
 	"axiomiety/go-bt/bencode"
-	"axiomiety/go-bt/common"
 	"axiomiety/go-bt/data"
 	"axiomiety/go-bt/torrent"
 	"axiomiety/go-bt/tracker"
 	"bytes"
 	"context"
-	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
 	"log"
+	"maps"
 	"net"
-	"net/url"
 	"os"
+	"slices"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -29,50 +29,176 @@ type PeerManager struct {
 	InfoHash        [20]byte
 	Context         context.Context
 	PeerId          [20]byte
-	TrackerURL      url.URL
-	BitField        data.BitField
-	PeerPoolSize    int
-	BaseDirectory   string
+	// what we tell trackers peers can reach us on - the IP is only needed
+	// if it isn't the one the tracker sees us coming from
+	ListenPort uint
+	ExternalIP string
+	// nil if the torrent doesn't have any trackers we can use
+	Trackers      *tracker.TrackerList
+	BitField      data.BitField
+	Pieces        *PieceTracker
+	PeerPoolSize  int
+	BaseDirectory string
+	// upper bound on the requests we pipeline with any one peer
+	MaxOutstandingRequests int
+	// how many peers we upload to at once, on top of the optimistic unchoke
+	UploadSlots    int
+	optimisticPeer string
+	// these apply to this torrent only, on top of the global limiters
+	DownloadLimiter *RateLimiter
+	UploadLimiter   *RateLimiter
+	// what our handlers have to tell us - see PeerEvent
+	Events chan PeerEvent
+	// keep going once we have everything so others can download from us
+	Seed bool
+	// peers that sent us bad data
+	Bans *BanList
+	// the IP of every peer we've come across, so we can still ban it once
+	// it's gone
+	peerIPs map[string]string
+	// what we received for pieces that failed their hash check, see pieceFailed
+	suspects map[uint32][]suspectBlock
+	// every peer we could connect to
+	Candidates *CandidatePool
+	// how long an unchoked peer can go without sending us anything before
+	// we consider it's snubbing us, and how long we wait on any one request
+	SnubTimeout    time.Duration
+	RequestTimeout time.Duration
+	// payload traffic for the torrent as a whole, which the tracker wants
+	// to hear about
+	Downloaded RateMeter
+	Uploaded   RateMeter
+	// where we're at with the tracker - see nextEvent. These are only
+	// touched by the loop.
+	started          bool
+	completedPending bool
 }
 
-func (p *PeerManager) QueryTracker() {
+// how often we look for new peers and make sure the ones we have are
+// kept busy, on top of reacting to what they tell us
+const PEER_REFRESH_INTERVAL = 30 * time.Second
 
+// how often we announce ourselves to the tracker if it doesn't say
+const DEFAULT_ANNOUNCE_INTERVAL = 30 * time.Second
+
+// how long we spend saying goodbye to the trackers on the way out
+const LEAVE_TIMEOUT = 10 * time.Second
+
+func (p *PeerManager) QueryTracker(ctx context.Context, event string) (*data.BETrackerResponse, error) {
 	q := data.TrackerQuery{
-		InfoHash: tracker.EncodeBytes(p.InfoHash),
-		PeerId:   tracker.EncodeBytes(p.PeerId),
-		// eventually that'll be an option
-		Port: 6688,
-		// Compact: false,
-	}
-	resp := tracker.QueryTrackerRaw(&p.TrackerURL, &q)
-	p.TrackerResponse = bencode.ParseFromReader[data.BETrackerResponse](bytes.NewReader(resp))
+		InfoHash:   tracker.EncodeBytes(p.InfoHash),
+		PeerId:     tracker.EncodeBytes(p.PeerId),
+		Port:       p.ListenPort,
+		IP:         p.ExternalIP,
+		Uploaded:   uint(p.Uploaded.Total()),
+		Downloaded: uint(p.Downloaded.Total()),
+		Left:       uint(p.bytesLeft()),
+		Event:      event,
+		Compact:    true,
+	}
+	response, err := p.Trackers.Announce(ctx, &q)
+	p.logTrackers()
+	if err != nil {
+		return nil, err
+	}
 	log.Print("tracker responded")
+	return response, nil
 }
 
-func (p *PeerManager) ejectPeersInErrorState() {
-	p.PeerHandlerLock.Lock()
-	defer p.PeerHandlerLock.Unlock()
-	peersToRemove := []string{}
-	for peerId, peer := range p.PeerHandlers {
-		if peer.State == ERROR {
-			peersToRemove = append(peersToRemove, peerId)
+// logTrackers shows how each tracker we've tried fared
+func (p *PeerManager) logTrackers() {
+	for tierIdx, tier := range p.Trackers.Status() {
+		for _, status := range tier {
+			if status.LastAnnounce.IsZero() {
+				continue
+			}
+			if status.LastError != nil {
+				log.Printf("tracker %s (tier %d): %s", status.URL.String(), tierIdx, status.LastError)
+			} else {
+				log.Printf("tracker %s (tier %d): %d peer(s), next announce at %s", status.URL.String(), tierIdx, status.NumPeers, status.NextAnnounce.Format(time.TimeOnly))
+			}
 		}
 	}
-	for _, peerId := range peersToRemove {
-		log.Printf("dropping peer %s because it is in an ERROR state", hex.EncodeToString([]byte(peerId)))
-		delete(p.PeerHandlers, peerId)
+}
+
+// announceInterval is how long the tracker wants us to wait before we
+// announce ourselves again
+func announceInterval(response *data.BETrackerResponse) time.Duration {
+	interval := DEFAULT_ANNOUNCE_INTERVAL
+	if response.Interval > 0 {
+		interval = time.Duration(response.Interval) * time.Second
+	}
+	// some trackers send a min interval that's longer than the interval
+	return max(interval, time.Duration(response.MinInterval)*time.Second)
+}
+
+// dropPeer disconnects from the peer and forgets about it. The caller must
+// hold the PeerHandlerLock.
+func (p *PeerManager) dropPeer(peerId string) {
+	handler, ok := p.PeerHandlers[peerId]
+	if !ok {
+		return
 	}
+	handler.Close()
+	// peers we never got to talk to may well be unreachable
+	if handler.Status.Ready {
+		p.Candidates.Disconnected(handler.Peer, time.Now())
+	} else {
+		p.Candidates.Failed(handler.Peer, time.Now())
+	}
+	delete(p.PeerHandlers, peerId)
+	// the piece tracker knows the handler by the key it started out with
+	p.Pieces.ReleasePeer(handler.key())
+	p.forgetPeerIPs()
 }
 
+// forgetPeerIPs drops the IPs of peers that are gone and didn't send us any
+// of the pieces we're still working on - suspects keep their own copy of
+// the IP, so there's nothing left to ban them for. The caller must hold the
+// PeerHandlerLock.
+func (p *PeerManager) forgetPeerIPs() {
+	keep := p.Pieces.Contributors()
+	for _, handler := range p.PeerHandlers {
+		keep[handler.key()] = true
+	}
+	for peerId := range p.peerIPs {
+		if !keep[peerId] {
+			delete(p.peerIPs, peerId)
+		}
+	}
+}
+
+// peers scoring this or lower are the ones we'd rather swap for new ones
+const EJECT_SCORE_THRESHOLD = 2
+
+// how many peers we eject at a time - it's pretty arbitrary though...
+const MAX_EJECTED_PEERS = 2
+
+// ejectNotSoUsefulPeers makes room for new peers by dropping the ones with
+// the lowest scores, as long as the pool is full and they're below
+// EJECT_SCORE_THRESHOLD
 func (p *PeerManager) ejectNotSoUsefulPeers() int {
-	availability := p.GetPiecesAvailability()
+	p.PeerHandlerLock.Lock()
+	defer p.PeerHandlerLock.Unlock()
+	if len(p.PeerHandlers) < p.PeerPoolSize {
+		return 0
+	}
+	availability := p.piecesAvailability()
 
 	// we key by score
 	ordered := map[uint32][]*PeerHandler{}
-	keys := make([]uint32, len(p.PeerHandlers))
+	keys := make([]uint32, 0, len(p.PeerHandlers))
 
 	for _, peer := range p.PeerHandlers {
+		// peers still connecting haven't had a chance to prove themselves,
+		// and peers we're uploading to are useful in their own way
+		if !peer.Status.Ready || (peer.Status.PeerInterested && !peer.Status.AmChoking) {
+			continue
+		}
 		score := p.GetPeerScore(availability, peer)
+		if score > EJECT_SCORE_THRESHOLD {
+			continue
+		}
 		level := ordered[score]
 		level = append(level, peer)
 		ordered[score] = level
@@ -81,65 +207,167 @@ func (p *PeerManager) ejectNotSoUsefulPeers() int {
 
 	// lowest score first!
 	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
-	// eject up to 2 peers at a time - it's pretty arbitrary though...
-	numToEject := 2
-	// we'll cap this to peers with a score of 2 or lower
+	keys = slices.Compact(keys)
 	numEjected := 0
 
-	p.PeerHandlerLock.Lock()
-	defer p.PeerHandlerLock.Unlock()
-
 	for _, score := range keys {
 		for _, peer := range ordered[score] {
-			if numToEject == numEjected {
+			if numEjected == MAX_EJECTED_PEERS {
 				break
 			}
-			peerId := string([]byte(peer.PeerId[:]))
-			delete(p.PeerHandlers, peerId)
-			log.Printf("dropping peer %s because of its low score: %d", hex.EncodeToString(peer.PeerId[:]), score)
+			peerId := peer.Status.Key
+			p.dropPeer(peerId)
+			log.Printf("dropping peer %s because of its low score: %d", hex.EncodeToString([]byte(peerId)), score)
 			numEjected += 1
 		}
 	}
 	return numEjected
 }
 
+func (p *PeerManager) newPeerHandler(peer *data.BEPeer) *PeerHandler {
+	handler := MakePeerHandler(peer, p.PeerId, p.InfoHash, p.Torrent.Info.GetNumPieces())
+	handler.MaxQueueDepth = p.MaxOutstandingRequests
+	handler.Pieces = p.Pieces
+	handler.Storage = p
+	handler.DownloadLimiters = []*RateLimiter{GlobalDownloadLimiter, p.DownloadLimiter}
+	handler.UploadLimiters = []*RateLimiter{GlobalUploadLimiter, p.UploadLimiter}
+	handler.Events = p.Events
+	if p.SnubTimeout > 0 {
+		handler.SnubTimeout = p.SnubTimeout
+	}
+	if p.RequestTimeout > 0 {
+		handler.RequestTimeout = p.RequestTimeout
+	}
+	handler.Status = PeerStatus{
+		Key:         handler.key(),
+		BitField:    data.NewBitField(p.Torrent.Info.GetNumPieces()),
+		PeerChoking: true,
+		AmChoking:   true,
+	}
+	p.peerIPs[handler.key()] = peer.IP
+	return handler
+}
+
+// AddIncomingPeer takes over a connection accepted by the Listener, whose
+// handshake matched our info hash
+func (p *PeerManager) AddIncomingPeer(conn net.Conn, handshake *data.Handshake) {
+	p.PeerHandlerLock.Lock()
+	defer p.PeerHandlerLock.Unlock()
+
+	peerId := string(handshake.PeerId[:])
+	_, known := p.PeerHandlers[peerId]
+	// we leave room for inbound peers on top of the ones we connect to
+	host, portStr, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if known || p.Context == nil || peerId == string(p.PeerId[:]) || len(p.PeerHandlers) >= 2*p.PeerPoolSize || p.Bans.IsBanned(host) || p.dialling(host) {
+		log.Printf("turning down incoming peer %s", hex.EncodeToString([]byte(peerId)))
+		conn.Close()
+		return
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 32)
+	handler := p.newPeerHandler(&data.BEPeer{
+		Id:   peerId,
+		IP:   host,
+		Port: uint32(port),
+	})
+	handler.Accept(conn, handshake)
+	p.PeerHandlers[peerId] = handler
+	log.Printf("accepted incoming peer %s - %s", hex.EncodeToString([]byte(peerId)), conn.RemoteAddr())
+	handler.Start(p.Context)
+}
+
+// dialling is true if we're connecting to the IP and don't know who's there
+// yet - it may well be the peer that's calling us, and that connection will
+// tell us once its handshake is done. The caller must hold the
+// PeerHandlerLock.
+func (p *PeerManager) dialling(ip string) bool {
+	for key, handler := range p.PeerHandlers {
+		if handler.Peer.IP == ip && key == candidateKey(handler.Peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadBlock reads a block of a piece we have back from disk
+func (p *PeerManager) ReadBlock(ref BlockRef) ([]byte, error) {
+	if !p.Pieces.HasPiece(ref.Index) {
+		return nil, fmt.Errorf("we don't have piece %d", ref.Index)
+	}
+	pieceSize := p.Torrent.Info.GetPieceSize(ref.Index)
+	if ref.Begin > pieceSize || ref.Length > pieceSize-ref.Begin {
+		return nil, fmt.Errorf("block %+v is out of bounds for a piece of %d bytes", ref, pieceSize)
+	}
+	offset := ref.Index*p.Torrent.Info.PieceLength + ref.Begin
+	segments := torrent.GetSegments(&p.Torrent.Info, offset, ref.Length)
+	return torrent.ReadSegments(segments, p.BaseDirectory)
+}
+
+// VerifyExistingData checks whatever is already on disk against the
+// pieces' hashes so we don't download (and can seed) what we already have
+func (p *PeerManager) VerifyExistingData() {
+	for pieceIdx := range p.Torrent.Info.GetNumPieces() {
+		segments := torrent.GetSegmentsForPiece(&p.Torrent.Info, pieceIdx)
+		pieceData, err := torrent.ReadSegments(segments, p.BaseDirectory)
+		if err != nil {
+			continue
+		}
+		digest := sha1.Sum(pieceData)
+		if bytes.Equal(digest[:], []byte(p.Torrent.Info.Pieces[pieceIdx*20:(pieceIdx+1)*20])) {
+			p.BitField.SetPiece(pieceIdx)
+			p.Pieces.PieceVerified(pieceIdx)
+		}
+	}
+	log.Printf("found %d/%d piece(s) on disk", p.BitField.Count(), p.BitField.NumPieces())
+}
+
 func (p *PeerManager) UpdatePeers() {
 	// TODO: expand
 	// there's a ton of stuff we could do here - e.g. if our peers don't cover
 	// the blocks we require, we could disconnect and find new ones
-	// we can also discard peers we've had trouble connecting to in the past,
-	// or ones that are chocked
 
-	// start by ejecting peers
-	p.ejectPeersInErrorState()
+	// peers that ran into trouble are already gone - see handleEvent
 	p.ejectNotSoUsefulPeers()
+	p.connectPeers()
 
-	// if we have space in our peer pool, try to add a new one!
-	if len(p.PeerHandlers) < p.PeerPoolSize {
-		for _, peer := range p.TrackerResponse.Peers {
-			// do we know the peer?
-			if _, ok := p.PeerHandlers[peer.Id]; ok {
-				log.Printf("peer %s is already known, skipping", hex.EncodeToString([]byte(peer.Id)))
-				continue
-			}
-			// let's not try to connect to ourselves
-			if peer.Id != string(p.PeerId[:]) && peer.Port != 6688 {
-				log.Printf("enquing peer %s - %s", hex.EncodeToString([]byte(peer.Id)), net.JoinHostPort(peer.IP, fmt.Sprintf("%d", peer.Port)))
-				// we're using a range - peer gets reassigned
-				// at every iteration! c.f. the below for a more in-depth explanation
-				// https://medium.com/swlh/use-pointer-of-for-range-loop-variable-in-go-3d3481f7ffc9
-				myPeer := peer
-				handler := MakePeerHandler(&myPeer, p.PeerId, p.InfoHash, uint32(len(p.Torrent.Info.Pieces)))
-				p.PeerHandlers[peer.Id] = handler
-				// now establish a connection!
-				// TODO: mmm - each handler should have its own context
-				go handler.Loop(p.Context)
-			}
-		}
-	}
+	p.PeerHandlerLock.Lock()
+	defer p.PeerHandlerLock.Unlock()
+	log.Printf("%d peer(s) connected out of %d candidate(s)", len(p.PeerHandlers), p.Candidates.Len())
 	for _, handler := range p.PeerHandlers {
-		log.Printf("peerHandler: remote peer %s, state=%d", hex.EncodeToString([]byte(handler.Peer.Id)), handler.State)
+		log.Printf("peerHandler: remote peer %s, ready=%t, client=%s", hex.EncodeToString([]byte(handler.Peer.Id)), handler.Status.Ready, handler.Status.Client)
+	}
+}
+
+// connectPeers fills up our peer pool with candidates. Handlers connect in
+// the background so we dial all of them at once.
+func (p *PeerManager) connectPeers() {
+	p.PeerHandlerLock.Lock()
+	defer p.PeerHandlerLock.Unlock()
+	if p.Context == nil || len(p.PeerHandlers) >= p.PeerPoolSize {
+		return
+	}
+	peers := p.Candidates.Next(time.Now(), p.PeerPoolSize-len(p.PeerHandlers), func(peer *data.BEPeer) bool {
+		_, known := p.PeerHandlers[peerKey(peer)]
+		return known || p.Bans.IsBanned(peer.IP) || p.isSelf(peer)
+	})
+	for _, peer := range peers {
+		log.Printf("enquing peer %s - %s", hex.EncodeToString([]byte(peer.Id)), candidateKey(&peer))
+		handler := p.newPeerHandler(&peer)
+		p.PeerHandlers[handler.Status.Key] = handler
+		// now establish a connection!
+		handler.Start(p.Context)
+	}
+}
+
+// isSelf tells whether the peer is us - trackers send us back to
+// ourselves, and compact peer lists don't come with peer IDs
+func (p *PeerManager) isSelf(peer *data.BEPeer) bool {
+	if peer.Id == string(p.PeerId[:]) {
+		return true
+	}
+	if peer.Port != uint32(p.ListenPort) {
+		return false
 	}
+	return (p.ExternalIP != "" && peer.IP == p.ExternalIP) || isLocalIP(peer.IP)
 }
 
 func FromTorrentFile(filename string) *PeerManager {
@@ -147,76 +375,73 @@ func FromTorrentFile(filename string) *PeerManager {
 	infoDict := obj["info"].(map[string]any)
 	digest := torrent.CalculateInfoHashFromInfoDict(infoDict)
 
-	baseUrl, err := url.Parse(obj["announce"].(string))
-	common.Check(err)
-
 	// generate a random peer ID
-	peerId := make([]byte, 20)
-	rand.Read(peerId)
 	// maybe we should read this once only o_O
 	file, _ := os.Open(filename)
 	defer file.Close()
 
 	var mu sync.Mutex
 	t := bencode.ParseFromReader[data.BETorrent](file)
+	// in memory only - callers that want bans to stick around can swap in
+	// their own
+	bans, _ := NewBanList("")
+	trackers, err := tracker.NewTrackerList(t.Announce, t.AnnounceList)
+	if err != nil {
+		log.Printf("we'll have to do without a tracker: %s", err)
+	}
 	return &PeerManager{
 		Torrent:         t,
 		InfoHash:        digest,
 		PeerHandlers:    make(map[string]*PeerHandler),
 		PeerHandlerLock: &mu,
-		PeerId:          [20]byte(peerId),
-		TrackerURL:      *baseUrl,
-		BitField: data.BitField{
-			Field: make([]byte, len(t.Info.Pieces)/20),
-		},
+		PeerId:          NewPeerId(),
+		ListenPort:      DEFAULT_LISTEN_PORT,
+		Trackers:        trackers,
+		BitField:        data.NewBitField(t.Info.GetNumPieces()),
+		Pieces:          NewPieceTracker(&t.Info, &RarestFirstPicker{}),
 		// hard-coded for now
-		PeerPoolSize:  5,
-		BaseDirectory: "/tmp",
-	}
-}
-
-func (p *PeerManager) queryTrackerAndUpdatePeersList(ctx context.Context) {
-	select {
-	case <-ctx.Done():
-		return
-	default:
-		p.QueryTracker()
-		p.UpdatePeers()
+		PeerPoolSize:           5,
+		BaseDirectory:          "/tmp",
+		MaxOutstandingRequests: DEFAULT_MAX_QUEUE_DEPTH,
+		UploadSlots:            DEFAULT_UPLOAD_SLOTS,
+		// unlimited until told otherwise
+		DownloadLimiter: NewRateLimiter(0),
+		UploadLimiter:   NewRateLimiter(0),
+		Events:          make(chan PeerEvent, EVENT_QUEUE_SIZE),
+		Bans:            bans,
+		peerIPs:         map[string]string{},
+		suspects:        map[uint32][]suspectBlock{},
+		Candidates:      NewCandidatePool(),
+		SnubTimeout:     SNUB_TIMEOUT,
+		RequestTimeout:  REQUEST_TIMEOUT,
 	}
 }
 
 func (p *PeerManager) DownloadNextPiece() bool {
 	didAnything := false
+	p.PeerHandlerLock.Lock()
+	p.Pieces.UpdateAvailability(p.piecesAvailability())
+	handlers := maps.Clone(p.PeerHandlers)
+	p.PeerHandlerLock.Unlock()
 
-	// is there a race condition vs when that's updated?
-	pendingPieces := map[uint32]bool{}
-	for _, handler := range p.PeerHandlers {
-		if handler.State == REQUESTING_PIECE {
-			pendingPieces[handler.PendingPiece.Index] = true
-		}
-	}
-	for pieceNum := range p.BitField.NumPieces() {
-		_, pieceIsBeingDownloaded := pendingPieces[pieceNum]
-		if !p.BitField.HasPiece(pieceNum) && !pieceIsBeingDownloaded {
-			for peerId, handler := range p.PeerHandlers {
-				if handler.State == UNCHOKED && handler.BitField.HasPiece(pieceNum) {
-					log.Printf("peer %x is UNCHOKED and has piece %d", peerId, pieceNum)
-					// usually we'd request PIECE_LENGTH, but if this is e.g. the last
-					// piece, the size of the piece may be less than the piece size
-					// specified in the info dict
-					handler.RequestPiece(pieceNum, p.Torrent.Info.GetPieceSize(pieceNum))
-					didAnything = true
-				}
-			}
+	// handlers top up their queues as blocks come in - this is for
+	// peers that have just announced new pieces, or whose blocks were
+	// released by another peer
+	for peerId, handler := range handlers {
+		if numRequested := handler.RequestBlocks(); numRequested > 0 {
+			log.Printf("requested %d block(s) from peer %x", numRequested, peerId)
+			didAnything = true
 		}
 	}
 	return didAnything
 }
 
+// PeerHasPieceOfInterest is true if the peer has a piece we don't. The
+// caller must hold the PeerHandlerLock.
 func (p *PeerManager) PeerHasPieceOfInterest(h *PeerHandler) bool {
-	// a peer has a piece of interest if we don't already have it
-	for idx := range p.BitField.NumPieces() {
-		if !p.BitField.HasPiece(idx) && h.BitField.HasPiece(idx) {
+	have := p.Pieces.Have()
+	for idx := range have.NumPieces() {
+		if !have.HasPiece(idx) && h.Status.BitField.HasPiece(idx) {
 			return true
 		}
 	}
@@ -224,12 +449,20 @@ func (p *PeerManager) PeerHasPieceOfInterest(h *PeerHandler) bool {
 }
 
 func (p *PeerManager) GetPiecesAvailability() map[uint32]uint32 {
+	p.PeerHandlerLock.Lock()
+	defer p.PeerHandlerLock.Unlock()
+	return p.piecesAvailability()
+}
+
+// the caller must hold the PeerHandlerLock
+func (p *PeerManager) piecesAvailability() map[uint32]uint32 {
+	have := p.Pieces.Have()
 	availability := map[uint32]uint32{}
-	for idx := range p.BitField.NumPieces() {
-		if !p.BitField.HasPiece(idx) {
+	for idx := range have.NumPieces() {
+		if !have.HasPiece(idx) {
 			availability[idx] = 0
 			for _, peerHandler := range p.PeerHandlers {
-				if peerHandler.BitField.HasPiece(idx) {
+				if peerHandler.Status.BitField.HasPiece(idx) {
 					availability[idx] += 1
 				}
 			}
@@ -248,17 +481,19 @@ func GetPiecesScore(b data.BitField, availability map[uint32]uint32, numPeers ui
 	return score
 }
 
+// GetPeerScore rates how useful a peer is to us. The caller must hold the
+// PeerHandlerLock.
 func (p *PeerManager) GetPeerScore(availability map[uint32]uint32, h *PeerHandler) uint32 {
 	// not yet unchocked!
 	if p.PeerHasPieceOfInterest(h) {
-		score := GetPiecesScore(h.BitField, availability, uint32(len(p.PeerHandlers)))
-		if h.State == READY {
+		score := GetPiecesScore(h.Status.BitField, availability, uint32(len(p.PeerHandlers)))
+		if h.Status.PeerChoking {
 			// we're chocked - halve the score
 			return score / 2
 		} else {
 			return score
 		}
-	} else if h.State == UNCHOKED {
+	} else if !h.Status.PeerChoking {
 		// peer is unchocked but it doesn't currently have
 		// any piece we're interested in
 		return 1
@@ -269,58 +504,302 @@ func (p *PeerManager) GetPeerScore(availability map[uint32]uint32, h *PeerHandle
 }
 
 func (p *PeerManager) processCompletedPieces() {
-	for peerId, peer := range p.PeerHandlers {
-		if peer.State == PIECE_COMPLETE {
-			h := sha1.New()
-			h.Write(peer.PendingPiece.Data)
-			digest := h.Sum(nil)
-			pieceIdx := peer.PendingPiece.Index
-			log.Printf("downloaded piece %d from peer %s with sha1: %s", pieceIdx, hex.EncodeToString([]byte(peerId)), hex.EncodeToString(digest))
-			expectedDigest := []byte(p.Torrent.Info.Pieces[pieceIdx*20 : (pieceIdx+1)*20])
-			if bytes.Equal(expectedDigest, digest) {
-				segments := torrent.GetSegmentsForPiece(&p.Torrent.Info, pieceIdx)
-				torrent.WriteSegments(segments, peer.PendingPiece.Data, p.BaseDirectory)
-				p.BitField.SetPiece(pieceIdx)
-				//TODO: let all other peers know we have a new piece
-			} else {
-				log.Printf("digest mismatch - expected %s, got %s", hex.EncodeToString(expectedDigest), hex.EncodeToString(digest))
+	for _, piece := range p.Pieces.TakeCompleted() {
+		h := sha1.New()
+		h.Write(piece.Data)
+		digest := h.Sum(nil)
+		pieceIdx := piece.Index
+		log.Printf("downloaded piece %d from %d peer(s) with sha1: %s", pieceIdx, len(piece.Contributors()), hex.EncodeToString(digest))
+		expectedDigest := []byte(p.Torrent.Info.Pieces[pieceIdx*20 : (pieceIdx+1)*20])
+		if bytes.Equal(expectedDigest, digest) {
+			segments := torrent.GetSegmentsForPiece(&p.Torrent.Info, pieceIdx)
+			torrent.WriteSegments(segments, piece.Data, p.BaseDirectory)
+			p.BitField.SetPiece(pieceIdx)
+			p.Pieces.PieceVerified(pieceIdx)
+			p.pieceVerified(piece)
+			p.broadcastHave(pieceIdx)
+		} else {
+			log.Printf("digest mismatch - expected %s, got %s", hex.EncodeToString(expectedDigest), hex.EncodeToString(digest))
+			p.pieceFailed(piece)
+		}
+		p.PeerHandlerLock.Lock()
+		p.forgetPeerIPs()
+		p.PeerHandlerLock.Unlock()
+	}
+}
+
+// bytesLeft is how much of the torrent we still need to verify
+func (p *PeerManager) bytesLeft() uint64 {
+	have := p.Pieces.Have()
+	left := uint64(p.Torrent.Info.GetTotalLength())
+	for pieceIdx := range have.NumPieces() {
+		if have.HasPiece(pieceIdx) {
+			left -= uint64(p.Torrent.Info.GetPieceSize(pieceIdx))
+		}
+	}
+	return left
+}
+
+func (p *PeerManager) IsComplete() bool {
+	have := p.Pieces.Have()
+	return have.Count() == have.NumPieces()
+}
+
+// broadcastHave lets every peer we're connected to know we have the piece
+func (p *PeerManager) broadcastHave(pieceIdx uint32) {
+	p.PeerHandlerLock.Lock()
+	handlers := []*PeerHandler{}
+	for _, handler := range p.PeerHandlers {
+		if handler.Status.Ready {
+			handlers = append(handlers, handler)
+		}
+	}
+	p.PeerHandlerLock.Unlock()
+	for _, handler := range handlers {
+		handler.Have(pieceIdx)
+	}
+}
+
+// handleEvent updates our view of the peer the event came from
+func (p *PeerManager) handleEvent(event PeerEvent) {
+	handler := event.Source()
+	p.PeerHandlerLock.Lock()
+	// the peer may have been dropped while the event was on its way, and
+	// it may even have come back since
+	if p.PeerHandlers[handler.Status.Key] != handler {
+		p.PeerHandlerLock.Unlock()
+		return
+	}
+	pieceComplete := false
+	blocksReleased := false
+	peerDropped := false
+	cancelling := []*PeerHandler{}
+	switch event := event.(type) {
+	case *ReadyEvent:
+		handler.Status.Ready = true
+		handler.Status.Client = ClientName(event.PeerId)
+		p.Candidates.Connected(handler.Peer)
+		log.Printf("peer %s is running %s", candidateKey(handler.Peer), handler.Status.Client)
+		// compact peer lists don't come with IDs, so this may be a peer
+		// we're already talking to under another address
+		peerId := string(event.PeerId[:])
+		if other, ok := p.PeerHandlers[peerId]; ok && other != handler {
+			log.Printf("already connected to peer %s, dropping %s", hex.EncodeToString([]byte(peerId)), candidateKey(handler.Peer))
+			p.Candidates.Identify(handler.Peer, peerId)
+			p.dropPeer(handler.Status.Key)
+			peerDropped = true
+			break
+		}
+		if handler.Status.Key != peerId {
+			p.Candidates.Identify(handler.Peer, peerId)
+			delete(p.PeerHandlers, handler.Status.Key)
+			handler.Status.Key = peerId
+			p.PeerHandlers[peerId] = handler
+		}
+	case *BitfieldEvent:
+		handler.Status.BitField = event.BitField
+		p.Pieces.UpdateAvailability(p.piecesAvailability())
+	case *HaveEvent:
+		handler.Status.BitField.SetPiece(event.Index)
+		p.Pieces.UpdateAvailability(p.piecesAvailability())
+	case *ChokeEvent:
+		handler.Status.PeerChoking = event.Choked
+		blocksReleased = event.Choked
+	case *InterestEvent:
+		handler.Status.PeerInterested = event.Interested
+	case *BlockEvent:
+		p.Downloaded.Add(int(event.Ref.Length))
+		pieceComplete = event.PieceComplete
+		// the piece tracker goes by the keys handlers started out with
+		for _, other := range p.PeerHandlers {
+			if slices.Contains(event.Cancelled, other.key()) {
+				cancelling = append(cancelling, other)
 			}
-			// reset the state - it's ready to download pieces again
-			peer.State = READY
 		}
+	case *TimeoutEvent:
+		blocksReleased = true
+	case *UploadEvent:
+		p.Uploaded.Add(int(event.Ref.Length))
+	case *ErrorEvent:
+		log.Printf("dropping peer %s: %s", hex.EncodeToString([]byte(handler.Status.Key)), event.Err)
+		p.dropPeer(handler.Status.Key)
+		p.Pieces.UpdateAvailability(p.piecesAvailability())
+		blocksReleased = true
+		peerDropped = true
+	}
+	p.PeerHandlerLock.Unlock()
+
+	// no point in the slower peers sending what we already have
+	for _, other := range cancelling {
+		other.RequestBlocks()
+	}
+	// someone else can have its spot
+	if peerDropped {
+		p.connectPeers()
+	}
+	if pieceComplete {
+		p.processCompletedPieces()
+	}
+	// whatever the peer was meant to send us can go to someone else
+	if blocksReleased {
+		p.DownloadNextPiece()
 	}
 }
 
-func (p *PeerManager) Run() {
-	log.Printf("peerManager ID (ours): %s", hex.EncodeToString(p.PeerId[:]))
-	ctx, cancelFunc := context.WithCancel(context.Background())
-	defer func() {
-		cancelFunc()
+// trackerAnnounce is what came of an announce made in the background
+type trackerAnnounce struct {
+	event    string
+	response *data.BETrackerResponse
+	err      error
+}
+
+// nextEvent is what we have to tell the tracker on our next announce -
+// events get sent again until the tracker acknowledges them
+func (p *PeerManager) nextEvent() string {
+	if !p.started {
+		return data.EVENT_STARTED
+	} else if p.completedPending {
+		return data.EVENT_COMPLETED
+	}
+	return ""
+}
+
+// announce queries the tracker in the background - it can take a while
+// and we have peers to look after in the meantime. It returns false if
+// there's no tracker to announce to.
+func (p *PeerManager) announce(ctx context.Context, announces chan<- trackerAnnounce) bool {
+	if p.Trackers == nil {
+		return false
+	}
+	event := p.nextEvent()
+	go func() {
+		response, err := p.QueryTracker(ctx, event)
+		select {
+		case announces <- trackerAnnounce{event: event, response: response, err: err}:
+		case <-ctx.Done():
+		}
 	}()
-	p.Context = ctx
+	return true
+}
+
+// loop reacts to what our handlers tell us as it happens, and keeps the
+// tracker, the choker and our peer pool going on timers. It returns once
+// the download is complete (unless we're seeding) or the context is
+// cancelled.
+func (p *PeerManager) loop(ctx context.Context) {
+	trackerAnnounces := make(chan trackerAnnounce)
+	// announces still going when we leave are no longer of any use
+	announceCtx, cancelAnnounces := context.WithCancel(ctx)
+	defer cancelAnnounces()
+	// one announce at a time - the timer going off while one is under way
+	// is ignored, but the tracker hearing we're done has to wait for it
+	announcing := p.announce(announceCtx, trackerAnnounces)
+	completedWaiting := false
+	announceTimer := time.NewTimer(DEFAULT_ANNOUNCE_INTERVAL)
+	defer announceTimer.Stop()
+	retryInterval := DEFAULT_ANNOUNCE_INTERVAL
+
+	chokeTicker := time.NewTicker(CHOKE_INTERVAL)
+	defer chokeTicker.Stop()
+	p.Rechoke(true)
+	chokeRound := 1
 
-	// periodic ping to the tracker to ensure we still show up
-	// as a valid peer
-	// TODO: this should ideally have the right event sent out
-	// to the tracker depending on which state we're in
-	go func(ctx context.Context) {
-		p.queryTrackerAndUpdatePeersList(ctx)
-		time.Sleep(30 * time.Second)
-	}(ctx)
+	refreshTicker := time.NewTicker(PEER_REFRESH_INTERVAL)
+	defer refreshTicker.Stop()
 
+	// the tracker only wants to hear we're done if we did the downloading
+	wasComplete := p.IsComplete()
 	for {
+		if complete := p.IsComplete(); complete && !wasComplete {
+			log.Printf("download complete!")
+			wasComplete = true
+			p.completedPending = true
+			if p.Seed && announcing {
+				completedWaiting = true
+			} else if p.Seed {
+				announcing = p.announce(announceCtx, trackerAnnounces)
+			}
+		}
+		if !p.Seed && wasComplete {
+			return
+		}
 		select {
 		case <-ctx.Done():
 			return
-		default:
-
-			p.processCompletedPieces()
-			if p.DownloadNextPiece() {
-				log.Print("found new piece(s) to download!")
+		case event := <-p.Events:
+			p.handleEvent(event)
+		case announced := <-trackerAnnounces:
+			announcing = false
+			if announced.err != nil {
+				// we'll try again, without going over what the tracker
+				// told us last time
+				log.Printf("announce failed: %s", announced.err)
+				announceTimer.Reset(retryInterval)
 			} else {
-				log.Print("nothing to download - but are we complete?")
+				switch announced.event {
+				case data.EVENT_STARTED:
+					p.started = true
+				case data.EVENT_COMPLETED:
+					p.completedPending = false
+				}
+				response := announced.response
+				p.PeerHandlerLock.Lock()
+				p.TrackerResponse = response
+				p.PeerHandlerLock.Unlock()
+				p.Candidates.Add(response.Peers...)
+				p.Candidates.Add(response.Peers6...)
+				p.UpdatePeers()
+				retryInterval = max(DEFAULT_ANNOUNCE_INTERVAL, time.Duration(response.MinInterval)*time.Second)
+				announceTimer.Reset(announceInterval(response))
 			}
+			if completedWaiting {
+				completedWaiting = false
+				announcing = p.announce(announceCtx, trackerAnnounces)
+			}
+		case <-announceTimer.C:
+			if !announcing {
+				announcing = p.announce(announceCtx, trackerAnnounces)
+			}
+		case <-chokeTicker.C:
+			p.Rechoke(chokeRound%OPTIMISTIC_UNCHOKE_ROUNDS == 0)
+			chokeRound += 1
+		case <-refreshTicker.C:
+			p.processCompletedPieces()
+			p.UpdatePeers()
+			p.DownloadNextPiece()
+		}
+	}
+}
+
+// Run downloads the torrent, returning once it's done or the context is
+// cancelled - either way, all our peers get disconnected
+func (p *PeerManager) Run(ctx context.Context) {
+	log.Printf("peerManager ID (ours): %s", hex.EncodeToString(p.PeerId[:]))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	p.PeerHandlerLock.Lock()
+	p.Context = ctx
+	p.PeerHandlerLock.Unlock()
+	p.VerifyExistingData()
+	p.loop(ctx)
+	p.leave()
+}
+
+// leave lets the tracker know we're going, and that we completed the
+// download if it hasn't heard about that yet. We don't hang around for
+// more than LEAVE_TIMEOUT as the tracker will forget about us eventually.
+func (p *PeerManager) leave() {
+	if p.Trackers == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), LEAVE_TIMEOUT)
+	defer cancel()
+	if p.completedPending {
+		if _, err := p.QueryTracker(ctx, data.EVENT_COMPLETED); err != nil {
+			log.Printf("unable to announce we're done: %s", err)
 		}
-		time.Sleep(5 * time.Second)
+	}
+	if _, err := p.QueryTracker(ctx, data.EVENT_STOPPED); err != nil {
+		log.Printf("unable to announce we're leaving: %s", err)
 	}
 }
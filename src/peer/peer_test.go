@@ -4,8 +4,26 @@ import (
 	"axiomiety/go-bt/bencode"
 	"axiomiety/go-bt/data"
 	"axiomiety/go-bt/torrent"
+	"axiomiety/go-bt/tracker"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
 	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGetHandshake(t *testing.T) {
@@ -49,3 +67,1019 @@ func TestGetPiecesScore(t *testing.T) {
 		t.Errorf("expected a score of 4, got %d", score)
 	}
 }
+
+func TestRequestPipelining(t *testing.T) {
+	pieceLength := 3*BLOCK_SIZE + 100
+	info := &data.BEInfo{PieceLength: pieceLength, Length: pieceLength}
+	handler := MakePeerHandler(&data.BEPeer{Id: "peer"}, [20]byte{}, [20]byte{}, 1)
+	handler.Pieces = NewPieceTracker(info, &SequentialPicker{})
+	handler.BitField.SetPiece(0)
+
+	// without a Loop, whatever the handler would have sent stays queued
+	expectRequests := func(offsets ...uint32) {
+		t.Helper()
+		sent := handler.takeQueued()
+		for idx, offset := range offsets {
+			if idx >= len(sent) {
+				t.Errorf("expected a request for offset %d but nothing was sent", offset)
+				continue
+			}
+			parsed, _ := data.ParseMessage(sent[idx].MessageId, sent[idx].Payload)
+			request, ok := parsed.(*data.RequestMessage)
+			if !ok || request.Begin != offset || request.Length != min(BLOCK_SIZE, pieceLength-offset) {
+				t.Errorf("expected a request for offset %d, got %+v", offset, parsed)
+			}
+		}
+		if len(sent) > len(offsets) {
+			t.Errorf("%d unexpected message(s) were sent", len(sent)-len(offsets))
+		}
+	}
+	block := func(offset uint32) *data.PieceMessage {
+		return &data.PieceMessage{Index: 0, Begin: offset, Block: make([]byte, min(BLOCK_SIZE, pieceLength-offset))}
+	}
+
+	// nothing gets requested until we're unchoked, and then only up to
+	// the minimum queue depth
+	if handler.RequestBlocks() != 0 {
+		t.Errorf("requested blocks while choked")
+	}
+	handler.processIncoming(&data.UnchokeMessage{})
+	expectRequests(0, BLOCK_SIZE)
+
+	// blocks can arrive in any order, each one freeing up a slot
+	handler.receiveBlock(block(BLOCK_SIZE))
+	expectRequests(2 * BLOCK_SIZE)
+	handler.receiveBlock(block(0))
+	expectRequests(3 * BLOCK_SIZE)
+
+	handler.receiveBlock(block(3 * BLOCK_SIZE))
+	handler.receiveBlock(block(2 * BLOCK_SIZE))
+	expectRequests()
+	if completed := handler.Pieces.TakeCompleted(); len(completed) != 1 || completed[0].Index != 0 {
+		t.Errorf("expected piece 0 to be complete, got %+v", completed)
+	}
+}
+
+func TestQueueWithoutWaiting(t *testing.T) {
+	info := &data.BEInfo{PieceLength: BLOCK_SIZE, Length: BLOCK_SIZE}
+	handler := MakePeerHandler(&data.BEPeer{Id: "busy"}, [20]byte{}, [20]byte{}, 1)
+	handler.Pieces = NewPieceTracker(info, &SequentialPicker{})
+	handler.BitField.SetPiece(0)
+	handler.State = UNCHOKED
+	// there's no Loop to send anything, as if it were busy writing to a
+	// slow peer - the manager mustn't have to wait on it
+	returned := make(chan struct{})
+	go func() {
+		handler.RequestBlocks()
+		handler.SetChoking(false)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatalf("queueing messages waited on the Loop")
+	}
+	expected := []*data.Message{data.Request(0, 0, BLOCK_SIZE), data.Unchoke()}
+	if sent := handler.takeQueued(); !reflect.DeepEqual(sent, expected) {
+		t.Errorf("expected %+v to be queued in order, got %+v", expected, sent)
+	}
+}
+
+func TestPieceTracker(t *testing.T) {
+	// 2 pieces of 3 blocks each
+	pieceLength := 3 * BLOCK_SIZE
+	info := &data.BEInfo{PieceLength: pieceLength, Length: 2 * pieceLength}
+	tracker := NewPieceTracker(info, &SequentialPicker{})
+	everything := data.BitField{Field: []byte{0xc0}, Size: 2}
+
+	// a peer can work on more than one piece at a time
+	blocks := tracker.NextBlocks("peer1", &everything, 4)
+	if len(blocks) != 4 || blocks[3].Index != 1 {
+		t.Fatalf("expected 3 blocks of piece 0 and 1 of piece 1, got %+v", blocks)
+	}
+	// and another peer picks up where it left off
+	blocks2 := tracker.NextBlocks("peer2", &everything, 2)
+	if len(blocks2) != 2 || blocks2[0].Index != 1 || blocks2[0].Begin != BLOCK_SIZE {
+		t.Fatalf("expected the last 2 blocks of piece 1, got %+v", blocks2)
+	}
+
+	// peer1 delivers part of piece 0 and then goes away
+	tracker.ReceiveBlock("peer1", blocks[0], make([]byte, BLOCK_SIZE))
+	tracker.ReleasePeer("peer1")
+	if _, ok := tracker.Partial[0]; !ok {
+		t.Fatalf("piece 0 should have survived peer1 going away")
+	}
+	// peer2 can now finish piece 0 off
+	blocks3 := tracker.NextBlocks("peer2", &everything, 4)
+	if len(blocks3) != 3 || blocks3[0].Index != 0 || blocks3[0].Begin != BLOCK_SIZE {
+		t.Fatalf("expected peer1's outstanding blocks, got %+v", blocks3)
+	}
+	for _, block := range blocks3[:2] {
+		tracker.ReceiveBlock("peer2", block, make([]byte, BLOCK_SIZE))
+	}
+	completed := tracker.TakeCompleted()
+	if len(completed) != 1 || completed[0].Index != 0 {
+		t.Fatalf("expected piece 0 to be complete, got %+v", completed)
+	}
+	if contributors := completed[0].Contributors(); len(contributors) != 2 {
+		t.Errorf("expected 2 peers to have contributed to piece 0, got %v", contributors)
+	}
+	tracker.PieceVerified(0)
+	if len(tracker.TakeCompleted()) != 0 {
+		t.Errorf("piece 0 should only be handed out once")
+	}
+}
+
+func TestInterest(t *testing.T) {
+	pieceLength := BLOCK_SIZE
+	info := &data.BEInfo{PieceLength: pieceLength, Length: 2 * pieceLength}
+	handler := MakePeerHandler(&data.BEPeer{Id: "peer"}, [20]byte{}, [20]byte{}, 2)
+	handler.Pieces = NewPieceTracker(info, &SequentialPicker{})
+	expectMessages := func(expected ...*data.Message) {
+		t.Helper()
+		if sent := handler.takeQueued(); !reflect.DeepEqual(sent, expected) && len(sent)+len(expected) > 0 {
+			t.Errorf("expected %+v, got %+v", expected, sent)
+		}
+	}
+
+	handler.processIncoming(&data.BitfieldMessage{BitField: data.BitField{Field: []byte{0x80}}})
+	expectMessages(data.Interested())
+	// the peer getting more pieces doesn't change anything
+	handler.processIncoming(&data.HaveMessage{Index: 1})
+	expectMessages()
+
+	handler.Pieces.PieceVerified(0)
+	handler.Have(0)
+	expectMessages(data.Have(0))
+	// once we have everything the peer has, we're no longer interested
+	handler.Pieces.PieceVerified(1)
+	handler.Have(1)
+	expectMessages(data.Have(1), data.NotInterested())
+}
+
+func TestQueueDepth(t *testing.T) {
+	if depth := queueDepth(0, 64); depth != MIN_QUEUE_DEPTH {
+		t.Errorf("expected %d for an idle peer, got %d", MIN_QUEUE_DEPTH, depth)
+	}
+	// 160KiB/s over 3 seconds is 30 blocks
+	if depth := queueDepth(10*float64(BLOCK_SIZE), 64); depth != 30 {
+		t.Errorf("expected 30, got %d", depth)
+	}
+	if depth := queueDepth(1<<30, 64); depth != 64 {
+		t.Errorf("expected the depth to be capped at 64, got %d", depth)
+	}
+
+	handler := MakePeerHandler(&data.BEPeer{}, [20]byte{}, [20]byte{}, 1)
+	handler.processExtendedHandshake([]byte("d1:mde4:reqqi16ee"))
+	if handler.maxQueueDepth() != 16 {
+		t.Errorf("expected the peer's reqq of 16 to be honoured, got %d", handler.maxQueueDepth())
+	}
+	// garbage shouldn't bring us down
+	handler.processExtendedHandshake([]byte("d4:reqqi"))
+}
+
+func TestPiecePickers(t *testing.T) {
+	availability := map[uint32]uint32{0: 3, 1: 1, 2: 2, 3: 1, 4: 5}
+	have := data.NewBitField(8)
+
+	picked := (&RarestFirstPicker{}).Pick([]uint32{0, 1, 2, 3, 4}, availability, &have)
+	// 1 and 3 are equally rare, so either can come first
+	if !slices.Equal(picked[2:], []uint32{2, 0, 4}) || !slices.Contains(picked[:2], 1) || !slices.Contains(picked[:2], 3) {
+		t.Errorf("expected the rarest pieces first, got %v", picked)
+	}
+
+	picked = (&SequentialPicker{}).Pick([]uint32{4, 2, 0}, availability, &have)
+	if !slices.Equal(picked, []uint32{0, 2, 4}) {
+		t.Errorf("expected pieces in order, got %v", picked)
+	}
+
+	// once we have enough pieces, random first turns into rarest first
+	randomFirst := &RandomFirstPicker{NumRandomPieces: 2}
+	have.SetPiece(5)
+	have.SetPiece(6)
+	picked = randomFirst.Pick([]uint32{4, 0, 2}, availability, &have)
+	if !slices.Equal(picked, []uint32{2, 0, 4}) {
+		t.Errorf("expected the rarest pieces first, got %v", picked)
+	}
+
+	if _, err := PickerFromName("fastest"); err == nil {
+		t.Errorf("expected an error for an unknown strategy")
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	// a single piece of 2 blocks
+	pieceLength := 2 * BLOCK_SIZE
+	tracker := NewPieceTracker(&data.BEInfo{PieceLength: pieceLength, Length: pieceLength}, &SequentialPicker{})
+	everything := data.BitField{Field: []byte{0x80}, Size: 1}
+
+	blocks := tracker.NextBlocks("slow", &everything, 4)
+	if len(blocks) != 2 {
+		t.Fatalf("expected both blocks to be requested from the slow peer, got %+v", blocks)
+	}
+	// everything has been requested - time to ask someone else
+	duplicates := tracker.NextBlocks("fast", &everything, 4)
+	if !tracker.InEndgame() || !slices.Equal(duplicates, blocks) {
+		t.Fatalf("expected the same blocks to be requested in endgame mode, got %+v", duplicates)
+	}
+	// but we don't ask the same peer twice
+	if again := tracker.NextBlocks("fast", &everything, 4); len(again) != 0 {
+		t.Errorf("expected no more blocks for the fast peer, got %+v", again)
+	}
+
+	// peers we didn't ask don't get to fill in blocks
+	tracker.ReceiveBlock("stranger", blocks[0], make([]byte, BLOCK_SIZE))
+	if received := tracker.Partial[0].NumReceived; received != 0 {
+		t.Fatalf("expected the unrequested block to be discarded, got %d block(s)", received)
+	}
+
+	// the fast peer delivers, so the slow peer's requests should be cancelled
+	for _, block := range duplicates {
+		if _, cancelled := tracker.ReceiveBlock("fast", block, make([]byte, BLOCK_SIZE)); !slices.Equal(cancelled, []string{"slow"}) {
+			t.Errorf("expected the slow peer to have a cancel waiting, got %v", cancelled)
+		}
+	}
+	if cancels := tracker.TakeCancels("slow"); !slices.Equal(cancels, blocks) {
+		t.Errorf("expected both of the slow peer's requests to be cancelled, got %+v", cancels)
+	}
+	if cancels := tracker.TakeCancels("fast"); len(cancels) != 0 {
+		t.Errorf("the fast peer shouldn't have anything to cancel, got %+v", cancels)
+	}
+	if completed := tracker.TakeCompleted(); len(completed) != 1 || !slices.Equal(completed[0].Contributors(), []string{"fast"}) {
+		t.Errorf("expected the piece to be complete with the fast peer's data, got %+v", completed)
+	}
+}
+
+func TestEndgameCancels(t *testing.T) {
+	info, _ := randomTorrent(2*BLOCK_SIZE, 2*BLOCK_SIZE)
+	manager := testManager(context.Background(), &info, t.TempDir())
+	handlers := map[string]*PeerHandler{}
+	for _, id := range []string{"slow", "fast"} {
+		handler := MakePeerHandler(&data.BEPeer{Id: id}, [20]byte{}, [20]byte{}, 1)
+		handler.Pieces = manager.Pieces
+		handler.BitField.SetPiece(0)
+		handler.processIncoming(&data.UnchokeMessage{})
+		handler.takeQueued()
+		handler.Status.Key = id
+		manager.PeerHandlers[id] = handler
+		handlers[id] = handler
+	}
+
+	// the slow peer is told as soon as the fast one beats it to a block,
+	// rather than whenever it next gets round to sending us something
+	complete, cancelled := handlers["fast"].receiveBlock(&data.PieceMessage{Index: 0, Begin: 0, Block: make([]byte, BLOCK_SIZE)})
+	manager.handleEvent(&BlockEvent{Handler: handlers["fast"], Ref: BlockRef{Index: 0, Begin: 0, Length: BLOCK_SIZE}, PieceComplete: complete, Cancelled: cancelled})
+	if sent := handlers["slow"].takeQueued(); !reflect.DeepEqual(sent, []*data.Message{data.Cancel(0, 0, BLOCK_SIZE)}) {
+		t.Errorf("expected the slow peer's request to be cancelled, got %+v", sent)
+	}
+}
+
+func TestSeeding(t *testing.T) {
+	// a single file spanning 2 pieces, the last one being a short one
+	contents := make([]byte, 3*BLOCK_SIZE+10)
+	rand.Read(contents)
+	baseDir := t.TempDir()
+	os.WriteFile(path.Join(baseDir, "foo"), contents, 0644)
+	firstPiece := sha1.Sum(contents[:2*BLOCK_SIZE])
+	secondPiece := sha1.Sum(contents[2*BLOCK_SIZE:])
+	info := data.BEInfo{
+		Name:        "foo",
+		Length:      uint32(len(contents)),
+		PieceLength: 2 * BLOCK_SIZE,
+		Pieces:      string(firstPiece[:]) + string(secondPiece[:]),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager := testManager(ctx, &info, baseDir)
+	manager.Pieces = NewPieceTracker(&info, &SequentialPicker{})
+	manager.Seed = true
+	manager.VerifyExistingData()
+	go manager.loop(ctx)
+	if manager.BitField.Count() != 2 {
+		t.Fatalf("expected to find both pieces on disk")
+	}
+
+	listener := NewListener(0)
+	listener.Register(manager)
+	if err := listener.Listen(ctx); err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+
+	// a peer asking for a torrent we don't have gets the door shut in its face
+	conn, _ := net.Dial("tcp", listener.Addr().String())
+	conn.Write(data.GetHanshake([20]byte{1}, [20]byte{0xbe, 0xef}).ToBytes())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := data.ReadHandshake(conn); err == nil {
+		t.Errorf("expected the connection to be closed")
+	}
+	conn.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	peerId := [20]byte{1}
+	conn.Write(data.GetHanshake(peerId, manager.InfoHash).ToBytes())
+	if handshake, err := data.ReadHandshake(conn); err != nil || handshake.InfoHash != manager.InfoHash {
+		t.Fatalf("expected a handshake back, got %+v (%v)", handshake, err)
+	}
+	expectMessage := func(expected data.PeerMessage) {
+		t.Helper()
+		msg, err := data.ReadMessage(conn, 1<<16)
+		if err != nil || !reflect.DeepEqual(msg, expected) {
+			t.Fatalf("expected %+v, got %+v (%v)", expected, msg, err)
+		}
+	}
+	expectMessage(&data.BitfieldMessage{BitField: data.BitField{Field: []byte{0xc0}}})
+
+	// we're choked to begin with, so this is ignored
+	conn.Write(data.Request(0, 0, BLOCK_SIZE).ToBytes())
+	conn.Write(data.Interested().ToBytes())
+	// the choker would normally get round to it within CHOKE_INTERVAL
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		manager.PeerHandlerLock.Lock()
+		handler := manager.PeerHandlers[string([]byte{1})+string(make([]byte, 19))]
+		interested := handler != nil && handler.Status.PeerInterested
+		manager.PeerHandlerLock.Unlock()
+		if interested {
+			break
+		}
+	}
+	manager.Rechoke(true)
+	expectMessage(&data.UnchokeMessage{})
+	// the last block of the short piece
+	conn.Write(data.Request(1, BLOCK_SIZE, 10).ToBytes())
+	expectMessage(&data.PieceMessage{Index: 1, Begin: BLOCK_SIZE, Block: contents[3*BLOCK_SIZE:]})
+	// out of bounds requests are ignored
+	conn.Write(data.Request(1, BLOCK_SIZE, BLOCK_SIZE).ToBytes())
+	conn.Write(data.Request(0, BLOCK_SIZE, BLOCK_SIZE).ToBytes())
+	expectMessage(&data.PieceMessage{Index: 0, Begin: BLOCK_SIZE, Block: contents[BLOCK_SIZE : 2*BLOCK_SIZE]})
+}
+
+func TestRankPeers(t *testing.T) {
+	candidates := []chokeCandidate{
+		{key: "slow", rate: 10},
+		{key: "fastest", rate: 1000},
+		{key: "snubbed", rate: 5000, snubbed: true},
+		{key: "fast", rate: 500},
+		{key: "idle", rate: 0},
+	}
+	unchoked := rankPeers(candidates, 3)
+	if !slices.Equal(unchoked, []string{"fastest", "fast", "slow"}) {
+		t.Errorf("expected the 3 fastest peers that aren't snubbing us, got %v", unchoked)
+	}
+	if unchoked := rankPeers(candidates, 10); len(unchoked) != 4 {
+		t.Errorf("expected every peer bar the snubbed one, got %v", unchoked)
+	}
+}
+
+func TestEjectPeers(t *testing.T) {
+	info := &data.BEInfo{PieceLength: BLOCK_SIZE, Length: 8 * BLOCK_SIZE}
+	var mu sync.Mutex
+	manager := &PeerManager{
+		PeerHandlers:    map[string]*PeerHandler{},
+		PeerHandlerLock: &mu,
+		Pieces:          NewPieceTracker(info, &SequentialPicker{}),
+		PeerPoolSize:    4,
+		Candidates:      NewCandidatePool(),
+	}
+	addPeer := func(id string, pieces byte) {
+		handler := MakePeerHandler(&data.BEPeer{Id: id}, [20]byte{}, [20]byte{}, 8)
+		handler.Status = PeerStatus{Key: id, Ready: true, BitField: data.BitField{Field: []byte{pieces}, Size: 8}, AmChoking: true}
+		manager.PeerHandlers[id] = handler
+	}
+
+	// our only source stays put, whatever its score
+	addPeer("seed", 0xff)
+	addPeer("empty1", 0)
+	if ejected := manager.ejectNotSoUsefulPeers(); ejected != 0 {
+		t.Errorf("nobody should be ejected while there's room, got %d", ejected)
+	}
+
+	// once the pool is full, the peers with nothing for us make room
+	addPeer("empty2", 0)
+	addPeer("empty3", 0)
+	if ejected := manager.ejectNotSoUsefulPeers(); ejected != MAX_EJECTED_PEERS {
+		t.Errorf("expected %d peers to be ejected, got %d", MAX_EJECTED_PEERS, ejected)
+	}
+	if _, ok := manager.PeerHandlers["seed"]; !ok || len(manager.PeerHandlers) != 2 {
+		t.Errorf("expected the seed and a single empty peer to be left, got %v", slices.Collect(maps.Keys(manager.PeerHandlers)))
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewRateLimiter(10 * RATE_LIMIT_QUANTUM)
+	// the first second's worth goes straight through
+	for range 10 {
+		if wait := limiter.reserve(RATE_LIMIT_QUANTUM, now); wait != 0 {
+			t.Fatalf("expected the burst to go through, had to wait %s", wait)
+		}
+	}
+	// after which everyone queues up behind whoever asked first
+	first := limiter.reserve(RATE_LIMIT_QUANTUM, now)
+	second := limiter.reserve(RATE_LIMIT_QUANTUM, now)
+	if first != 100*time.Millisecond || second != 200*time.Millisecond {
+		t.Errorf("expected to wait 100ms then 200ms, got %s and %s", first, second)
+	}
+	// paying off the debt takes 200ms
+	if wait := limiter.reserve(RATE_LIMIT_QUANTUM, now.Add(300*time.Millisecond)); wait != 0 {
+		t.Errorf("expected the debt to be paid off, had to wait %s", wait)
+	}
+
+	limiter.SetRate(0)
+	if wait := limiter.reserve(1<<30, now); wait != 0 {
+		t.Errorf("expected no limit, had to wait %s", wait)
+	}
+	var noLimiter *RateLimiter
+	if wait := noLimiter.reserve(1<<30, now); wait != 0 {
+		t.Errorf("expected no limit, had to wait %s", wait)
+	}
+
+	// the slowest limiter is the one that counts
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := &RateLimitedConn{
+		Conn:          client,
+		WriteLimiters: []*RateLimiter{NewRateLimiter(0), NewRateLimiter(8 * RATE_LIMIT_QUANTUM)},
+	}
+	go io.Copy(io.Discard, server)
+	start := time.Now()
+	if n, err := conn.Write(make([]byte, 12*RATE_LIMIT_QUANTUM)); n != 12*RATE_LIMIT_QUANTUM || err != nil {
+		t.Fatalf("expected to write everything, wrote %d (%v)", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected the write to be throttled, took %s", elapsed)
+	}
+}
+
+// randomTorrent makes up a single file torrent of the given length
+func randomTorrent(length uint32, pieceLength uint32) (data.BEInfo, []byte) {
+	contents := make([]byte, length)
+	rand.Read(contents)
+	pieces := ""
+	for offset := uint32(0); offset < length; offset += pieceLength {
+		digest := sha1.Sum(contents[offset:min(offset+pieceLength, length)])
+		pieces += string(digest[:])
+	}
+	info := data.BEInfo{
+		Name:        "foo",
+		Length:      length,
+		PieceLength: pieceLength,
+		Pieces:      pieces,
+	}
+	return info, contents
+}
+
+// testManager sets up a manager the way FromTorrentFile would, minus the tracker
+func testManager(ctx context.Context, info *data.BEInfo, baseDir string) *PeerManager {
+	return &PeerManager{
+		Torrent:                &data.BETorrent{Info: *info},
+		InfoHash:               [20]byte{0xca, 0xfe},
+		PeerHandlers:           map[string]*PeerHandler{},
+		PeerHandlerLock:        &sync.Mutex{},
+		Context:                ctx,
+		PeerId:                 [20]byte{0xff},
+		BitField:               data.NewBitField(info.GetNumPieces()),
+		Pieces:                 NewPieceTracker(info, &RarestFirstPicker{}),
+		BaseDirectory:          baseDir,
+		PeerPoolSize:           5,
+		MaxOutstandingRequests: DEFAULT_MAX_QUEUE_DEPTH,
+		UploadSlots:            DEFAULT_UPLOAD_SLOTS,
+		Events:                 make(chan PeerEvent, EVENT_QUEUE_SIZE),
+		Bans:                   &BanList{banned: map[string]bool{}, failures: map[string]int{}},
+		peerIPs:                map[string]string{},
+		suspects:               map[uint32][]suspectBlock{},
+		Candidates:             NewCandidatePool(),
+	}
+}
+
+// fakeSeeder serves the whole torrent to the first peer that connects,
+// hanging up on it once it has served quitAfter requests (or never, if
+// negative)
+func fakeSeeder(t *testing.T, infoHash [20]byte, info *data.BEInfo, contents []byte, quitAfter int) data.BEPeer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var peerId [20]byte
+	rand.Read(peerId[:])
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := data.ReadHandshake(conn); err != nil {
+			return
+		}
+		conn.Write(data.GetHanshake(peerId, infoHash).ToBytes())
+		everything := data.NewBitField(info.GetNumPieces())
+		for idx := range info.GetNumPieces() {
+			everything.SetPiece(idx)
+		}
+		conn.Write(data.Bitfield(&everything).ToBytes())
+		conn.Write(data.Unchoke().ToBytes())
+		for numServed := 0; numServed != quitAfter; {
+			msg, err := data.ReadMessage(conn, 1<<16)
+			if err != nil {
+				return
+			}
+			request, ok := msg.(*data.RequestMessage)
+			if !ok {
+				continue
+			}
+			offset := request.Index*info.PieceLength + request.Begin
+			conn.Write(data.Piece(request.Index, request.Begin, contents[offset:offset+request.Length]).ToBytes())
+			numServed += 1
+		}
+	}()
+	return data.BEPeer{
+		Id:   string(peerId[:]),
+		IP:   "127.0.0.1",
+		Port: uint32(listener.Addr().(*net.TCPAddr).Port),
+	}
+}
+
+func TestMultiPeerDownload(t *testing.T) {
+	// 4 pieces of 2 blocks, the last one short
+	info, contents := randomTorrent(7*BLOCK_SIZE+100, 2*BLOCK_SIZE)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager := testManager(ctx, &info, t.TempDir())
+	manager.Candidates.Add(
+		fakeSeeder(t, manager.InfoHash, &info, contents, -1),
+		fakeSeeder(t, manager.InfoHash, &info, contents, -1),
+		// this one gives up on us after a single block
+		fakeSeeder(t, manager.InfoHash, &info, contents, 1),
+	)
+	done := make(chan struct{})
+	go func() {
+		manager.loop(ctx)
+		close(done)
+	}()
+	manager.UpdatePeers()
+
+	// the manager is done as soon as it has everything
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		have := manager.Pieces.Have()
+		t.Fatalf("only got %d/%d pieces", have.Count(), info.GetNumPieces())
+	}
+	downloaded, err := os.ReadFile(path.Join(manager.BaseDirectory, "foo"))
+	if err != nil || !slices.Equal(downloaded, contents) {
+		t.Errorf("the file on disk doesn't match what the seeders have (%v)", err)
+	}
+}
+
+func TestPeerChurn(t *testing.T) {
+	info, contents := randomTorrent(4*BLOCK_SIZE, 2*BLOCK_SIZE)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager := testManager(ctx, &info, t.TempDir())
+	// so the manager sticks around after the first round
+	manager.Seed = true
+	go manager.loop(ctx)
+	numGoroutines := runtime.NumGoroutine()
+
+	readyPeers := func() (numReady int, numPeers int) {
+		manager.PeerHandlerLock.Lock()
+		defer manager.PeerHandlerLock.Unlock()
+		for _, handler := range manager.PeerHandlers {
+			if handler.Status.Ready {
+				numReady += 1
+			}
+		}
+		return numReady, len(manager.PeerHandlers)
+	}
+	for round := range 3 {
+		// one peer hangs up on us straight away, we get rid of the others
+		manager.Candidates.Add(
+			fakeSeeder(t, manager.InfoHash, &info, contents, -1),
+			fakeSeeder(t, manager.InfoHash, &info, contents, -1),
+			fakeSeeder(t, manager.InfoHash, &info, contents, 0),
+		)
+		manager.UpdatePeers()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if numReady, numPeers := readyPeers(); numReady == 2 && numPeers == 2 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("round %d: expected to end up with 2 peers", round)
+			}
+		}
+		manager.PeerHandlerLock.Lock()
+		for peerId := range manager.PeerHandlers {
+			manager.dropPeer(peerId)
+		}
+		manager.PeerHandlerLock.Unlock()
+	}
+
+	// the fake seeders only go away once we've closed the connection, so
+	// this covers them too
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > numGoroutines; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutine(s) leaked:\n%s", runtime.NumGoroutine()-numGoroutines, buf[:runtime.Stack(buf, true)])
+		}
+	}
+}
+
+func TestBanList(t *testing.T) {
+	banPath := path.Join(t.TempDir(), "bans", "banned")
+	bans, err := NewBanList(banPath)
+	if err != nil {
+		t.Fatalf("a missing ban list should be fine, got %s", err)
+	}
+	for i := 1; i < MAX_HASH_FAILURES; i++ {
+		if bans.HashFailed("10.0.0.1") {
+			t.Fatalf("banned after only %d failure(s)", i)
+		}
+	}
+	if !bans.HashFailed("10.0.0.1") || !bans.IsBanned("10.0.0.1") {
+		t.Fatalf("expected a ban after %d failures", MAX_HASH_FAILURES)
+	}
+	if bans.IsBanned("10.0.0.2") {
+		t.Errorf("10.0.0.2 hasn't done anything wrong")
+	}
+
+	// bans stick around, strikes don't
+	bans.HashFailed("10.0.0.2")
+	reloaded, err := NewBanList(banPath)
+	if err != nil {
+		t.Fatalf("unable to reload the ban list: %s", err)
+	}
+	if !reloaded.IsBanned("10.0.0.1") || reloaded.IsBanned("10.0.0.2") {
+		t.Errorf("expected only 10.0.0.1 to be banned, got %v", reloaded.banned)
+	}
+}
+
+func TestSmartBan(t *testing.T) {
+	info, contents := randomTorrent(2*BLOCK_SIZE, 2*BLOCK_SIZE)
+	manager := testManager(context.Background(), &info, t.TempDir())
+	manager.peerIPs["good"] = "10.0.0.1"
+	manager.peerIPs["bad"] = "10.0.0.2"
+	everything := data.BitField{Field: []byte{0x80}, Size: 1}
+
+	// each peer sends us one block, one of which is garbage
+	good := manager.Pieces.NextBlocks("good", &everything, 1)
+	bad := manager.Pieces.NextBlocks("bad", &everything, 1)
+	manager.Pieces.ReceiveBlock("good", good[0], contents[:BLOCK_SIZE])
+	manager.Pieces.ReceiveBlock("bad", bad[0], make([]byte, BLOCK_SIZE))
+	manager.processCompletedPieces()
+	if manager.Pieces.HasPiece(0) {
+		t.Fatalf("the piece should have failed its hash check")
+	}
+	if manager.Bans.IsBanned("10.0.0.1") || manager.Bans.IsBanned("10.0.0.2") {
+		t.Fatalf("we can't tell who's at fault yet")
+	}
+	if len(manager.Bans.failures) != 0 {
+		t.Errorf("neither peer should be held responsible yet, got %v", manager.Bans.failures)
+	}
+
+	// so it gets downloaded again from a single peer
+	blocks := manager.Pieces.NextBlocks("good", &everything, 4)
+	if len(blocks) != 2 {
+		t.Fatalf("expected the whole piece to be requested from one peer, got %+v", blocks)
+	}
+	if others := manager.Pieces.NextBlocks("bad", &everything, 4); len(others) != 0 {
+		t.Fatalf("nobody else should be asked for the piece, got %+v", others)
+	}
+	// and only that peer gets to send it
+	manager.Pieces.ReceiveBlock("bad", blocks[0], make([]byte, BLOCK_SIZE))
+	if received := manager.Pieces.Partial[0].NumReceived; received != 0 {
+		t.Fatalf("expected the other peer's block to be discarded, got %d block(s)", received)
+	}
+	for _, block := range blocks {
+		manager.Pieces.ReceiveBlock("good", block, contents[block.Begin:block.Begin+block.Length])
+	}
+	manager.processCompletedPieces()
+	if !manager.Pieces.HasPiece(0) {
+		t.Fatalf("the piece should have been verified")
+	}
+	if !manager.Bans.IsBanned("10.0.0.2") || manager.Bans.IsBanned("10.0.0.1") {
+		t.Errorf("expected only the peer that sent the bad block to be banned, got %v", manager.Bans.banned)
+	}
+	// neither peer is connected and we're done with the piece
+	if len(manager.peerIPs) != 0 {
+		t.Errorf("expected the peers' IPs to be forgotten, got %v", manager.peerIPs)
+	}
+}
+
+func TestCandidatePool(t *testing.T) {
+	pool := NewCandidatePool()
+	flaky := data.BEPeer{IP: "10.0.0.1", Port: 6881}
+	solid := data.BEPeer{IP: "10.0.0.2", Port: 6881}
+	// the same peer from another source only counts once
+	pool.Add(flaky, solid, data.BEPeer{IP: "10.0.0.1", Port: 6881, Id: "flaky"})
+	if pool.Len() != 2 {
+		t.Fatalf("expected 2 candidates, got %d", pool.Len())
+	}
+	noSkip := func(*data.BEPeer) bool { return false }
+
+	now := time.Now()
+	if peers := pool.Next(now, 5, noSkip); len(peers) != 2 {
+		t.Fatalf("expected to dial both peers, got %+v", peers)
+	}
+	// nobody gets dialled twice at once
+	if peers := pool.Next(now, 5, noSkip); len(peers) != 0 {
+		t.Fatalf("expected both peers to be busy, got %+v", peers)
+	}
+
+	pool.Failed(&flaky, now)
+	pool.Disconnected(&solid, now)
+	if peers := pool.Next(now, 5, noSkip); len(peers) != 0 {
+		t.Fatalf("expected both peers to be backing off, got %+v", peers)
+	}
+	// peers that gave us less trouble go first
+	later := now.Add(CONNECT_BACKOFF)
+	if peers := pool.Next(later, 1, noSkip); len(peers) != 1 || peers[0].IP != solid.IP {
+		t.Fatalf("expected the solid peer first, got %+v", peers)
+	}
+	if peers := pool.Next(later, 1, noSkip); len(peers) != 1 || peers[0].Id != "flaky" {
+		t.Fatalf("expected the flaky peer next, got %+v", peers)
+	}
+
+	// the backoff doubles with every failure until we give up
+	for failures := 2; failures < MAX_CONNECT_ATTEMPTS; failures++ {
+		pool.Failed(&flaky, later)
+		backoff := CONNECT_BACKOFF << (failures - 1)
+		skipSolid := func(peer *data.BEPeer) bool { return peer.IP == solid.IP }
+		if peers := pool.Next(later.Add(backoff-time.Second), 5, skipSolid); len(peers) != 0 {
+			t.Fatalf("expected a backoff of %s after %d failures", backoff, failures)
+		}
+		later = later.Add(backoff)
+		if peers := pool.Next(later, 5, skipSolid); len(peers) != 1 {
+			t.Fatalf("expected the flaky peer to be retried after %s", backoff)
+		}
+	}
+	pool.Failed(&flaky, later)
+	if pool.Len() != 1 {
+		t.Errorf("expected to give up on the flaky peer after %d attempts", MAX_CONNECT_ATTEMPTS)
+	}
+	// and it stays given up on when trackers send it again
+	pool.Add(flaky)
+	pool.Disconnected(&solid, later)
+	if peers := pool.Next(later.Add(MAX_CONNECT_BACKOFF), 5, noSkip); len(peers) != 1 || peers[0].IP != solid.IP {
+		t.Errorf("expected only the solid peer to be dialled, got %+v", peers)
+	}
+}
+
+func TestDuplicatePeers(t *testing.T) {
+	info, _ := randomTorrent(2*BLOCK_SIZE, 2*BLOCK_SIZE)
+	manager := testManager(context.Background(), &info, t.TempDir())
+	first := data.BEPeer{IP: "127.0.0.1", Port: 6881}
+	second := data.BEPeer{IP: "127.0.0.1", Port: 6882}
+	manager.Candidates.Add(first, second)
+	peerId := [20]byte{0x42}
+
+	// we're dialling 127.0.0.1 and don't know who's there yet, so whoever
+	// calls us from there may well be the same peer
+	handler := manager.newPeerHandler(&first)
+	manager.PeerHandlers[handler.Status.Key] = handler
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("unable to accept: %s", err)
+	}
+	manager.AddIncomingPeer(conn, &data.Handshake{PeerId: peerId})
+	if len(manager.PeerHandlers) != 1 {
+		t.Fatalf("expected the incoming peer to be turned down, got %v", slices.Collect(maps.Keys(manager.PeerHandlers)))
+	}
+
+	// compact peers are filed under their address until the handshake
+	// tells us who they are
+	manager.handleEvent(&ReadyEvent{Handler: handler, PeerId: peerId})
+	if manager.PeerHandlers[string(peerId[:])] != handler || len(manager.PeerHandlers) != 1 {
+		t.Fatalf("expected the handler to be filed under its peer ID, got %v", slices.Collect(maps.Keys(manager.PeerHandlers)))
+	}
+	// the same peer under another address is turned away, and isn't
+	// dialled again while we're connected to it
+	duplicate := manager.newPeerHandler(&second)
+	manager.PeerHandlers[duplicate.Status.Key] = duplicate
+	manager.handleEvent(&ReadyEvent{Handler: duplicate, PeerId: peerId})
+	if manager.PeerHandlers[string(peerId[:])] != handler || len(manager.PeerHandlers) != 1 {
+		t.Errorf("expected the duplicate to be dropped, got %v", slices.Collect(maps.Keys(manager.PeerHandlers)))
+	}
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	pieceLength := 2 * BLOCK_SIZE
+	info := &data.BEInfo{PieceLength: pieceLength, Length: pieceLength}
+	pieces := NewPieceTracker(info, &SequentialPicker{})
+	handler := MakePeerHandler(&data.BEPeer{Id: "slow"}, [20]byte{}, [20]byte{}, 1)
+	handler.Pieces = pieces
+	handler.BitField.SetPiece(0)
+	handler.processIncoming(&data.UnchokeMessage{})
+	if len(handler.Outstanding) != 2 {
+		t.Fatalf("expected both blocks to be requested, got %+v", handler.Outstanding)
+	}
+
+	now := time.Now()
+	handler.lock.Lock()
+	expired := handler.housekeeping(now)
+	handler.lock.Unlock()
+	if len(expired) != 0 || handler.Snubbed {
+		t.Fatalf("nothing should have timed out yet, got %+v", expired)
+	}
+
+	// the peer sends one block and sits on the other one
+	handler.receiveBlock(&data.PieceMessage{Index: 0, Begin: 0, Block: make([]byte, BLOCK_SIZE)})
+	later := now.Add(max(REQUEST_TIMEOUT, SNUB_TIMEOUT) + time.Second)
+	handler.lock.Lock()
+	expired = handler.housekeeping(later)
+	handler.lock.Unlock()
+	if len(expired) != 1 || expired[0].Begin != BLOCK_SIZE || len(handler.Outstanding) != 0 {
+		t.Fatalf("expected the second block to time out, got %+v", expired)
+	}
+	if !handler.Snubbed || handler.QueueDepth != MIN_QUEUE_DEPTH {
+		t.Errorf("expected the peer to be snubbing us")
+	}
+	// someone else can now have a go at it, but not the peer that sat on it
+	everything := data.BitField{Field: []byte{0x80}, Size: 1}
+	if blocks := pieces.NextBlocks("slow", &everything, 4); len(blocks) != 0 {
+		t.Errorf("expected the timed out block to go to another peer, got %+v", blocks)
+	}
+	if blocks := pieces.NextBlocks("fast", &everything, 4); len(blocks) != 1 || blocks[0] != expired[0] {
+		t.Errorf("expected the timed out block to be up for grabs, got %+v", blocks)
+	}
+
+	// a late block still counts, and means we're no longer being snubbed
+	handler.receiveBlock(&data.PieceMessage{Index: 0, Begin: BLOCK_SIZE, Block: make([]byte, BLOCK_SIZE)})
+	if handler.Snubbed {
+		t.Errorf("the peer came through in the end")
+	}
+}
+
+func TestAnnounceLifecycle(t *testing.T) {
+	info, contents := randomTorrent(3*BLOCK_SIZE, 2*BLOCK_SIZE)
+	manager := testManager(context.Background(), &info, t.TempDir())
+	seeder := fakeSeeder(t, manager.InfoHash, &info, contents, -1)
+
+	var lock sync.Mutex
+	announces := []url.Values{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		announces = append(announces, req.URL.Query())
+		lock.Unlock()
+		// the seeder, in compact form
+		peers := string(net.ParseIP(seeder.IP).To4()) + string([]byte{byte(seeder.Port >> 8), byte(seeder.Port)})
+		fmt.Fprintf(w, "d8:intervali1800e5:peers%d:%s10:tracker id3:xyze", len(peers), peers)
+	}))
+	defer server.Close()
+	trackers, err := tracker.NewTrackerList(server.URL, nil)
+	if err != nil {
+		t.Fatalf("unable to set up the tracker: %s", err)
+	}
+	manager.Trackers = trackers
+
+	done := make(chan struct{})
+	go func() {
+		manager.Run(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		t.Fatalf("the download didn't complete")
+	}
+
+	total := fmt.Sprintf("%d", len(contents))
+	expected := []struct{ event, left, downloaded string }{
+		{data.EVENT_STARTED, total, "0"},
+		{data.EVENT_COMPLETED, "0", total},
+		{data.EVENT_STOPPED, "0", total},
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(announces) != len(expected) {
+		t.Fatalf("expected %d announces, got %v", len(expected), announces)
+	}
+	for i, announce := range announces {
+		if announce.Get("event") != expected[i].event || announce.Get("left") != expected[i].left || announce.Get("downloaded") != expected[i].downloaded || announce.Get("compact") != "1" {
+			t.Errorf("expected announce %d to be %+v, got %v", i, expected[i], announce)
+		}
+		// the tracker id gets echoed back once we have one
+		if trackerId := announce.Get("trackerid"); (i == 0 && trackerId != "") || (i > 0 && trackerId != "xyz") {
+			t.Errorf("unexpected tracker id %q in announce %d", trackerId, i)
+		}
+	}
+}
+
+func TestAnnounceInterval(t *testing.T) {
+	tests := []struct {
+		interval, minInterval int64
+		expected              time.Duration
+	}{
+		{0, 0, DEFAULT_ANNOUNCE_INTERVAL},
+		{1800, 0, 30 * time.Minute},
+		{1800, 900, 30 * time.Minute},
+		// min interval wins if the tracker contradicts itself
+		{60, 120, 2 * time.Minute},
+		{0, 3600, time.Hour},
+	}
+	for _, test := range tests {
+		response := &data.BETrackerResponse{Interval: test.interval, MinInterval: test.minInterval}
+		if interval := announceInterval(response); interval != test.expected {
+			t.Errorf("expected %s for %+v, got %s", test.expected, test, interval)
+		}
+	}
+}
+
+func TestPeerId(t *testing.T) {
+	peerId := NewPeerId()
+	if string(peerId[:8]) != "-GB0001-" {
+		t.Errorf("expected our prefix, got %s", peerId)
+	}
+	if other := NewPeerId(); other == peerId {
+		t.Errorf("expected peer IDs to be random, got %s twice", peerId)
+	}
+	if client := ClientName(peerId); client != "go-bt 0.0.0.1" {
+		t.Errorf("expected to recognise ourselves, got %s", client)
+	}
+
+	tests := map[string]string{
+		"-qB4360-abcdefghijkl":                         "qBittorrent 4.3.6.0",
+		"-XX1234-abcdefghijkl":                         "XX 1.2.3.4",
+		"T03I-----abcdefghijk":                         "BitTornado 0.3.18",
+		"S58B-----abcdefghijk":                         "Shadow's client 5.8.11",
+		"Tabcdefghijklmnopqrs":                         "unknown",
+		"\x00\x01\x02\x03\x04\x05\x06\x07abcdefghijkl": "unknown",
+	}
+	for id, expected := range tests {
+		if client := ClientName([20]byte([]byte(id))); client != expected {
+			t.Errorf("expected %s for %q, got %s", expected, id, client)
+		}
+	}
+}
+
+func TestListenPortRange(t *testing.T) {
+	if from, to, err := ParsePortRange("6881-6889"); err != nil || from != 6881 || to != 6889 {
+		t.Errorf("expected 6881-6889, got %d-%d (%v)", from, to, err)
+	}
+	if from, to, err := ParsePortRange("6688"); err != nil || from != 6688 || to != 6688 {
+		t.Errorf("expected 6688 alone, got %d-%d (%v)", from, to, err)
+	}
+	for _, ports := range []string{"", "abc", "6889-6881", "70000"} {
+		if _, _, err := ParsePortRange(ports); err == nil {
+			t.Errorf("expected %q to be rejected", ports)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer taken.Close()
+	port := taken.Addr().(*net.TCPAddr).Port
+	listener := NewListener(port)
+	listener.Host = "127.0.0.1"
+	if err := listener.Listen(ctx); err == nil {
+		t.Fatalf("expected the port to be taken")
+	}
+	listener.LastPort = port + 10
+	if err := listener.Listen(ctx); err != nil {
+		t.Fatalf("expected to fall back to another port: %s", err)
+	}
+	if listener.Port <= port || listener.Port > port+10 {
+		t.Errorf("expected a port after %d, got %d", port, listener.Port)
+	}
+}
+
+func TestIsSelf(t *testing.T) {
+	manager := PeerManager{PeerId: NewPeerId(), ListenPort: 6881, ExternalIP: "203.0.113.1"}
+	tests := []struct {
+		peer data.BEPeer
+		self bool
+	}{
+		{data.BEPeer{Id: string(manager.PeerId[:]), IP: "198.51.100.1", Port: 1234}, true},
+		{data.BEPeer{IP: "127.0.0.1", Port: 6881}, true},
+		{data.BEPeer{IP: "203.0.113.1", Port: 6881}, true},
+		{data.BEPeer{IP: "127.0.0.1", Port: 6882}, false},
+		{data.BEPeer{IP: "198.51.100.1", Port: 6881}, false},
+	}
+	for _, test := range tests {
+		if self := manager.isSelf(&test.peer); self != test.self {
+			t.Errorf("expected isSelf=%t for %+v", test.self, test.peer)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package peer
+
+import (
+	"axiomiety/go-bt/common"
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// Azureus-style, e.g. -GB0001- - other clients can tell who we are from it
+const PEER_ID_PREFIX = "-" + common.CLIENT_ID + common.CLIENT_VERSION + "-"
+
+// what the rest of the peer ID is made of - keeping it printable makes it
+// easier on trackers and logs
+const PEER_ID_CHARS = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// NewPeerId generates a peer ID made of our prefix and random characters
+func NewPeerId() [20]byte {
+	var peerId [20]byte
+	copy(peerId[:], PEER_ID_PREFIX)
+	random := peerId[len(PEER_ID_PREFIX):]
+	rand.Read(random)
+	for idx, b := range random {
+		random[idx] = PEER_ID_CHARS[int(b)%len(PEER_ID_CHARS)]
+	}
+	return peerId
+}
+
+// the two-letter codes from Azureus-style peer IDs that we're likely to
+// come across
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"GB": "go-bt",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"lt": "libtorrent (Rasterbar)",
+	"qB": "qBittorrent",
+}
+
+// and the letters from Shadow-style ones
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow's client",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowDigit decodes a version character from a Shadow-style peer ID,
+// returning -1 for anything that isn't one
+func shadowDigit(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'A' <= c && c <= 'Z':
+		return int(c-'A') + 10
+	case 'a' <= c && c <= 'z':
+		return int(c-'a') + 36
+	case c == '.':
+		return 62
+	}
+	return -1
+}
+
+// ClientName works out which client a peer is running from its peer ID,
+// e.g. "qBittorrent 4.3.6.0". Azureus-style (-qB4360-) and Shadow-style
+// (T03I-----) peer IDs are understood, for anything else we get "unknown".
+func ClientName(peerId [20]byte) string {
+	if peerId[0] == '-' && peerId[7] == '-' {
+		code := string(peerId[1:3])
+		name, ok := azureusClients[code]
+		if !ok {
+			name = code
+		}
+		version := []string{}
+		for _, c := range peerId[3:7] {
+			version = append(version, fmt.Sprintf("%d", max(shadowDigit(c), 0)))
+		}
+		return fmt.Sprintf("%s %s", name, strings.Join(version, "."))
+	}
+	if name, ok := shadowClients[peerId[0]]; ok {
+		// the version is up to 5 characters, padded with dashes
+		version := []string{}
+		for _, c := range peerId[1:6] {
+			if c == '-' {
+				break
+			}
+			digit := shadowDigit(c)
+			if digit < 0 {
+				return "unknown"
+			}
+			version = append(version, fmt.Sprintf("%d", digit))
+		}
+		if len(version) > 0 && string(peerId[len(version)+1:len(version)+4]) == "---" {
+			return fmt.Sprintf("%s %s", name, strings.Join(version, "."))
+		}
+	}
+	return "unknown"
+}
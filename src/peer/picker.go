@@ -0,0 +1,74 @@
+package peer
+
+import (
+	"axiomiety/go-bt/data"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+)
+
+// PiecePicker decides in which order we start downloading new pieces. It
+// gets handed the pieces a peer can give us that we haven't started yet,
+// along with how many of our peers have each piece we're missing.
+type PiecePicker interface {
+	Pick(candidates []uint32, availability map[uint32]uint32, have *data.BitField) []uint32
+}
+
+// SequentialPicker downloads pieces in order - handy for streaming, bad for
+// the swarm
+type SequentialPicker struct{}
+
+func (s *SequentialPicker) Pick(candidates []uint32, availability map[uint32]uint32, have *data.BitField) []uint32 {
+	slices.Sort(candidates)
+	return candidates
+}
+
+// RarestFirstPicker prefers pieces few of our peers have, so they don't
+// disappear from the swarm when those peers leave. Ties are broken randomly
+// so that peers with the same view of the swarm don't all go for the same
+// pieces.
+type RarestFirstPicker struct{}
+
+func (r *RarestFirstPicker) Pick(candidates []uint32, availability map[uint32]uint32, have *data.BitField) []uint32 {
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	slices.SortStableFunc(candidates, func(a, b uint32) int {
+		return int(availability[a]) - int(availability[b])
+	})
+	return candidates
+}
+
+// RandomFirstPicker picks pieces at random until we have a few complete
+// ones. Rare pieces take longer to download so when we have nothing to
+// offer, getting something we can trade quickly matters more.
+type RandomFirstPicker struct {
+	// once we have this many pieces we switch to rarest first
+	NumRandomPieces uint32
+	rarestFirst     RarestFirstPicker
+}
+
+func (r *RandomFirstPicker) Pick(candidates []uint32, availability map[uint32]uint32, have *data.BitField) []uint32 {
+	if have.Count() >= r.NumRandomPieces {
+		return r.rarestFirst.Pick(candidates, availability, have)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	return candidates
+}
+
+const DEFAULT_NUM_RANDOM_PIECES = 4
+
+func PickerFromName(name string) (PiecePicker, error) {
+	switch name {
+	case "rarest":
+		return &RarestFirstPicker{}, nil
+	case "random":
+		return &RandomFirstPicker{NumRandomPieces: DEFAULT_NUM_RANDOM_PIECES}, nil
+	case "sequential":
+		return &SequentialPicker{}, nil
+	default:
+		return nil, fmt.Errorf("unknown piece picking strategy: %s", name)
+	}
+}
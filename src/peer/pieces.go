@@ -0,0 +1,448 @@
+package peer
+
+import (
+	"axiomiety/go-bt/data"
+	"log"
+	"slices"
+	"sync"
+)
+
+type BlockState int
+
+const (
+	BLOCK_MISSING BlockState = iota
+	BLOCK_REQUESTED
+	BLOCK_RECEIVED
+)
+
+// BlockRef identifies a block within a piece - this is what goes in a
+// request (and a cancel) message
+type BlockRef struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// in endgame mode, how many peers we'll ask for the same block
+const MAX_REQUESTS_PER_BLOCK = 3
+
+type Block struct {
+	State BlockState
+	// the peers we asked for the block (more than one in endgame mode),
+	// and the one that ended up sending it
+	RequestedFrom []string
+	ReceivedFrom  string
+	// peers whose request for the block timed out - we don't ask them again
+	TimedOut []string
+}
+
+// release forgets about peerId's request for the block - once nobody is
+// downloading it, it's up for grabs again
+func (b *Block) release(peerId string) {
+	if b.State != BLOCK_REQUESTED {
+		return
+	}
+	b.RequestedFrom = slices.DeleteFunc(b.RequestedFrom, func(requester string) bool {
+		return requester == peerId
+	})
+	if len(b.RequestedFrom) == 0 {
+		b.State = BLOCK_MISSING
+	}
+}
+
+// PartialPiece is a piece we've started downloading. Its blocks can be
+// spread across several peers and it outlives any one of them.
+type PartialPiece struct {
+	Index       uint32
+	Data        []byte
+	Blocks      []Block
+	NumReceived int
+	// set once all the blocks are in and the manager has picked it up
+	Verifying bool
+	// pieces that failed their hash check with data from several peers get
+	// downloaded again from a single one, the Owner, so we can tell who
+	// sent the bad data
+	Exclusive bool
+	Owner     string
+}
+
+func (pp *PartialPiece) IsComplete() bool {
+	return pp.NumReceived == len(pp.Blocks)
+}
+
+func (pp *PartialPiece) blockRef(blockIdx int) BlockRef {
+	begin := uint32(blockIdx) * BLOCK_SIZE
+	return BlockRef{
+		Index:  pp.Index,
+		Begin:  begin,
+		Length: min(BLOCK_SIZE, uint32(len(pp.Data))-begin),
+	}
+}
+
+// Contributors returns the peers that sent us at least one block of this piece
+func (pp *PartialPiece) Contributors() []string {
+	peers := []string{}
+	for _, block := range pp.Blocks {
+		if block.State == BLOCK_RECEIVED && !slices.Contains(peers, block.ReceivedFrom) {
+			peers = append(peers, block.ReceivedFrom)
+		}
+	}
+	return peers
+}
+
+// PieceTracker keeps track of the state of every block we still need. It is
+// shared by all the peer handlers of a torrent, which ask it for blocks to
+// request and hand back whatever they receive.
+type PieceTracker struct {
+	lock    sync.Mutex
+	info    *data.BEInfo
+	have    data.BitField
+	Partial map[uint32]*PartialPiece
+	// decides which pieces get started next
+	Picker       PiecePicker
+	availability map[uint32]uint32
+	// once every block we need has been requested, we start asking other
+	// peers for the same blocks so a slow peer can't hold us up
+	endgame bool
+	// duplicate requests that got answered by someone else, by peer
+	cancels map[string][]BlockRef
+	// pieces that have to come from a single peer - see PartialPiece
+	exclusive map[uint32]bool
+}
+
+func NewPieceTracker(info *data.BEInfo, picker PiecePicker) *PieceTracker {
+	return &PieceTracker{
+		info:         info,
+		have:         data.NewBitField(info.GetNumPieces()),
+		Partial:      map[uint32]*PartialPiece{},
+		Picker:       picker,
+		availability: map[uint32]uint32{},
+		cancels:      map[string][]BlockRef{},
+		exclusive:    map[uint32]bool{},
+	}
+}
+
+// UpdateAvailability takes the number of peers that have each of the
+// pieces we're missing, as returned by PeerManager.GetPiecesAvailability
+func (t *PieceTracker) UpdateAvailability(availability map[uint32]uint32) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.availability = availability
+}
+
+// Have returns a copy of the pieces we've verified
+func (t *PieceTracker) Have() data.BitField {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	have := data.BitField{
+		Field: make([]byte, len(t.have.Field)),
+		Size:  t.have.Size,
+	}
+	copy(have.Field, t.have.Field)
+	return have
+}
+
+func (t *PieceTracker) HasPiece(idx uint32) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return idx < t.have.NumPieces() && t.have.HasPiece(idx)
+}
+
+func (t *PieceTracker) newPartialPiece(idx uint32) *PartialPiece {
+	pieceSize := t.info.GetPieceSize(idx)
+	pp := &PartialPiece{
+		Index:     idx,
+		Data:      make([]byte, pieceSize),
+		Blocks:    make([]Block, (pieceSize+BLOCK_SIZE-1)/BLOCK_SIZE),
+		Exclusive: t.exclusive[idx],
+	}
+	t.Partial[idx] = pp
+	return pp
+}
+
+// assign marks up to n missing blocks of the piece as requested by peerId
+func (pp *PartialPiece) assign(peerId string, n int) []BlockRef {
+	blocks := []BlockRef{}
+	if pp.Exclusive {
+		if pp.Owner == "" {
+			pp.Owner = peerId
+		} else if pp.Owner != peerId {
+			return blocks
+		}
+	}
+	for blockIdx := range pp.Blocks {
+		if len(blocks) == n {
+			break
+		}
+		block := &pp.Blocks[blockIdx]
+		if block.State == BLOCK_MISSING && !slices.Contains(block.TimedOut, peerId) {
+			block.State = BLOCK_REQUESTED
+			block.RequestedFrom = []string{peerId}
+			blocks = append(blocks, pp.blockRef(blockIdx))
+		}
+	}
+	return blocks
+}
+
+// assignDuplicates is assign's endgame counterpart - it hands out blocks
+// that have already been requested from other peers
+func (pp *PartialPiece) assignDuplicates(peerId string, n int) []BlockRef {
+	blocks := []BlockRef{}
+	if pp.Exclusive {
+		return blocks
+	}
+	for blockIdx := range pp.Blocks {
+		if len(blocks) == n {
+			break
+		}
+		block := &pp.Blocks[blockIdx]
+		if block.State == BLOCK_REQUESTED && len(block.RequestedFrom) < MAX_REQUESTS_PER_BLOCK && !slices.Contains(block.RequestedFrom, peerId) && !slices.Contains(block.TimedOut, peerId) {
+			block.RequestedFrom = append(block.RequestedFrom, peerId)
+			blocks = append(blocks, pp.blockRef(blockIdx))
+		}
+	}
+	return blocks
+}
+
+// allRequested is true when there's nothing left that nobody has been
+// asked for. The caller must hold the lock.
+func (t *PieceTracker) allRequested() bool {
+	for idx := range t.have.NumPieces() {
+		if t.have.HasPiece(idx) {
+			continue
+		}
+		pp, started := t.Partial[idx]
+		if !started {
+			return false
+		}
+		for _, block := range pp.Blocks {
+			if block.State == BLOCK_MISSING {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (t *PieceTracker) InEndgame() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.endgame
+}
+
+// NextBlocks hands out up to n blocks the peer has and nobody has been
+// asked for yet
+func (t *PieceTracker) NextBlocks(peerId string, peerHas *data.BitField, n int) []BlockRef {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	blocks := []BlockRef{}
+
+	// finish what we've started before starting anything new,
+	// otherwise we'll end up with lots of partial pieces
+	partialIdxs := make([]uint32, 0, len(t.Partial))
+	for idx := range t.Partial {
+		partialIdxs = append(partialIdxs, idx)
+	}
+	slices.Sort(partialIdxs)
+	for _, idx := range partialIdxs {
+		if len(blocks) == n {
+			return blocks
+		}
+		if peerHas.HasPiece(idx) {
+			blocks = append(blocks, t.Partial[idx].assign(peerId, n-len(blocks))...)
+		}
+	}
+
+	if len(blocks) == n {
+		return blocks
+	}
+	candidates := []uint32{}
+	for idx := range t.have.NumPieces() {
+		if _, started := t.Partial[idx]; !started && !t.have.HasPiece(idx) && peerHas.HasPiece(idx) {
+			candidates = append(candidates, idx)
+		}
+	}
+	for _, idx := range t.Picker.Pick(candidates, t.availability, &t.have) {
+		if len(blocks) == n {
+			break
+		}
+		blocks = append(blocks, t.newPartialPiece(idx).assign(peerId, n-len(blocks))...)
+	}
+
+	if len(blocks) < n && !t.endgame && t.allRequested() {
+		log.Printf("all remaining blocks have been requested, entering endgame mode")
+		t.endgame = true
+	}
+	if t.endgame {
+		for _, idx := range partialIdxs {
+			if len(blocks) == n {
+				break
+			}
+			if pp, ok := t.Partial[idx]; ok && peerHas.HasPiece(idx) {
+				blocks = append(blocks, pp.assignDuplicates(peerId, n-len(blocks))...)
+			}
+		}
+	}
+	return blocks
+}
+
+// ReceiveBlock stores the block's data and returns true if that
+// completed the piece, along with the other peers we'd asked for the block
+// - they now have a cancel waiting for them (see TakeCancels)
+func (t *PieceTracker) ReceiveBlock(peerId string, ref BlockRef, block []byte) (bool, []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	pp, ok := t.Partial[ref.Index]
+	if !ok || ref.Begin%BLOCK_SIZE != 0 || int(ref.Begin/BLOCK_SIZE) >= len(pp.Blocks) {
+		log.Printf("discarding block %+v we're not downloading", ref)
+		return false, nil
+	}
+	blockIdx := int(ref.Begin / BLOCK_SIZE)
+	if expected := pp.blockRef(blockIdx); uint32(len(block)) != expected.Length {
+		log.Printf("expected %d bytes for block %+v, got %d", expected.Length, ref, len(block))
+		return false, nil
+	}
+	// we may have given up on the peer already but the data is still good
+	if pp.Blocks[blockIdx].State == BLOCK_RECEIVED {
+		return false, nil
+	}
+	// only the peers we asked get a say in what goes in the piece, which
+	// for a piece we're re-downloading is its owner and nobody else
+	requested := slices.Contains(pp.Blocks[blockIdx].RequestedFrom, peerId)
+	if pp.Exclusive {
+		requested = pp.Owner == peerId
+	}
+	if !requested {
+		log.Printf("discarding block %+v we didn't ask %x for", ref, peerId)
+		return false, nil
+	}
+	copy(pp.Data[ref.Begin:], block)
+	// anyone else we asked for the block should be told not to bother
+	cancelled := []string{}
+	for _, requester := range pp.Blocks[blockIdx].RequestedFrom {
+		if requester != peerId {
+			t.cancels[requester] = append(t.cancels[requester], pp.blockRef(blockIdx))
+			cancelled = append(cancelled, requester)
+		}
+	}
+	pp.Blocks[blockIdx].State = BLOCK_RECEIVED
+	pp.Blocks[blockIdx].RequestedFrom = nil
+	pp.Blocks[blockIdx].TimedOut = nil
+	pp.Blocks[blockIdx].ReceivedFrom = peerId
+	pp.NumReceived += 1
+	return pp.IsComplete(), cancelled
+}
+
+// TakeCancels returns the requests we made to the peer which have since
+// been fulfilled by another peer
+func (t *PieceTracker) TakeCancels(peerId string) []BlockRef {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	cancels := t.cancels[peerId]
+	delete(t.cancels, peerId)
+	return cancels
+}
+
+// ReleaseBlocks puts blocks requested from peerId back up for grabs, e.g.
+// because we got choked or the peer went away
+func (t *PieceTracker) ReleaseBlocks(peerId string, refs ...BlockRef) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, ref := range refs {
+		if pp, ok := t.Partial[ref.Index]; ok {
+			pp.Blocks[ref.Begin/BLOCK_SIZE].release(peerId)
+		}
+	}
+	t.releaseExclusive(peerId)
+}
+
+// TimeOutBlocks is ReleaseBlocks for requests the peer didn't answer in
+// time - the blocks go to other peers rather than back to this one
+func (t *PieceTracker) TimeOutBlocks(peerId string, refs ...BlockRef) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, ref := range refs {
+		if pp, ok := t.Partial[ref.Index]; ok {
+			block := &pp.Blocks[ref.Begin/BLOCK_SIZE]
+			if block.State == BLOCK_REQUESTED && !slices.Contains(block.TimedOut, peerId) {
+				block.TimedOut = append(block.TimedOut, peerId)
+			}
+			block.release(peerId)
+		}
+	}
+	t.releaseExclusive(peerId)
+}
+
+// releaseExclusive starts the peer's exclusive pieces over so that another
+// peer can take them on from scratch. The caller must hold the lock.
+func (t *PieceTracker) releaseExclusive(peerId string) {
+	for idx, pp := range t.Partial {
+		if pp.Exclusive && pp.Owner == peerId && !pp.Verifying {
+			delete(t.Partial, idx)
+		}
+	}
+}
+
+// ReleasePeer releases every block requested from the peer
+func (t *PieceTracker) ReleasePeer(peerId string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, pp := range t.Partial {
+		for blockIdx := range pp.Blocks {
+			block := &pp.Blocks[blockIdx]
+			block.release(peerId)
+			// it gets a fresh start if it comes back
+			block.TimedOut = slices.DeleteFunc(block.TimedOut, func(timedOut string) bool {
+				return timedOut == peerId
+			})
+		}
+	}
+	t.releaseExclusive(peerId)
+	delete(t.cancels, peerId)
+}
+
+// TakeCompleted returns the pieces whose blocks have all been received
+// and which haven't been handed out for verification yet
+func (t *PieceTracker) TakeCompleted() []*PartialPiece {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	completed := []*PartialPiece{}
+	for _, pp := range t.Partial {
+		if pp.IsComplete() && !pp.Verifying {
+			pp.Verifying = true
+			completed = append(completed, pp)
+		}
+	}
+	return completed
+}
+
+// Contributors returns every peer that sent us a block of a piece we're
+// still working on
+func (t *PieceTracker) Contributors() map[string]bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	contributors := map[string]bool{}
+	for _, pp := range t.Partial {
+		for _, peerId := range pp.Contributors() {
+			contributors[peerId] = true
+		}
+	}
+	return contributors
+}
+
+func (t *PieceTracker) PieceVerified(idx uint32) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.Partial, idx)
+	delete(t.exclusive, idx)
+	t.have.SetPiece(idx)
+}
+
+// PieceFailed discards everything we downloaded for the piece so it gets
+// requested again from scratch - from a single peer if exclusive is set
+func (t *PieceTracker) PieceFailed(idx uint32, exclusive bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.Partial, idx)
+	t.exclusive[idx] = exclusive
+}
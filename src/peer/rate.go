@@ -0,0 +1,66 @@
+package peer
+
+import (
+	"sync"
+	"time"
+)
+
+// how often we fold the bytes received into the moving average
+const RATE_SAMPLE_INTERVAL = time.Second
+
+// weight given to the most recent sample - higher reacts faster
+const RATE_SMOOTHING = 0.3
+
+// RateMeter keeps track of a transfer rate (in bytes/second) as an
+// exponentially weighted moving average
+type RateMeter struct {
+	lock       sync.Mutex
+	total      uint64
+	pending    uint64
+	rate       float64
+	lastSample time.Time
+}
+
+func (r *RateMeter) Add(numBytes int) {
+	r.addAt(numBytes, time.Now())
+}
+
+func (r *RateMeter) addAt(numBytes int, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sample(now)
+	r.total += uint64(numBytes)
+	r.pending += uint64(numBytes)
+}
+
+func (r *RateMeter) Rate() float64 {
+	return r.rateAt(time.Now())
+}
+
+func (r *RateMeter) rateAt(now time.Time) float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sample(now)
+	return r.rate
+}
+
+func (r *RateMeter) Total() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.total
+}
+
+func (r *RateMeter) sample(now time.Time) {
+	if r.lastSample.IsZero() {
+		r.lastSample = now
+		return
+	}
+	elapsed := now.Sub(r.lastSample)
+	if elapsed < RATE_SAMPLE_INTERVAL {
+		return
+	}
+	current := float64(r.pending) / elapsed.Seconds()
+	r.rate = RATE_SMOOTHING*current + (1-RATE_SMOOTHING)*r.rate
+	r.pending = 0
+	r.lastSample = now
+}
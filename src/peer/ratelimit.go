@@ -0,0 +1,127 @@
+package peer
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// the most a connection reads or writes in one go when it's being rate
+// limited - keeping this small means peers take turns rather than one of
+// them using up the whole budget with a single large write
+const RATE_LIMIT_QUANTUM = 4096
+
+// RateLimiter is a token bucket where each token is a byte. Callers reserve
+// tokens ahead of time and the bucket is allowed to go into debt, which
+// makes them wait their turn in the order they asked - that's what keeps
+// things fair between peers sharing a limiter.
+type RateLimiter struct {
+	lock sync.Mutex
+	// in bytes/s - 0 means unlimited
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(bytesPerSecond int) *RateLimiter {
+	return &RateLimiter{rate: float64(bytesPerSecond)}
+}
+
+// shared by every torrent - these apply on top of each PeerManager's own limits
+var GlobalDownloadLimiter = NewRateLimiter(0)
+var GlobalUploadLimiter = NewRateLimiter(0)
+
+// SetRate can be called at any time, including while connections are
+// waiting on the limiter
+func (l *RateLimiter) SetRate(bytesPerSecond int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(time.Now())
+	l.rate = float64(bytesPerSecond)
+	l.tokens = min(l.tokens, l.burst())
+}
+
+func (l *RateLimiter) Rate() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int(l.rate)
+}
+
+// we allow up to a second's worth of data to go through in one burst
+func (l *RateLimiter) burst() float64 {
+	return max(l.rate, RATE_LIMIT_QUANTUM)
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst(), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	} else {
+		l.tokens = l.burst()
+	}
+	l.last = now
+}
+
+// reserve takes numBytes tokens and returns how long the caller has to
+// wait before it's allowed to use them. A nil limiter doesn't limit anything.
+func (l *RateLimiter) reserve(numBytes int, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill(now)
+	l.tokens -= float64(numBytes)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// waitForAll blocks until every limiter has numBytes available
+func waitForAll(limiters []*RateLimiter, numBytes int) {
+	now := time.Now()
+	wait := time.Duration(0)
+	for _, limiter := range limiters {
+		wait = max(wait, limiter.reserve(numBytes, now))
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// RateLimitedConn throttles reads and writes on a peer connection
+type RateLimitedConn struct {
+	net.Conn
+	ReadLimiters  []*RateLimiter
+	WriteLimiters []*RateLimiter
+}
+
+func (c *RateLimitedConn) Read(b []byte) (int, error) {
+	// we can't know how much we'll get ahead of time, so we pay afterwards -
+	// the wait holds up the next read, which in turn slows the peer down
+	if len(b) > RATE_LIMIT_QUANTUM {
+		b = b[:RATE_LIMIT_QUANTUM]
+	}
+	numBytesRead, err := c.Conn.Read(b)
+	if numBytesRead > 0 {
+		waitForAll(c.ReadLimiters, numBytesRead)
+	}
+	return numBytesRead, err
+}
+
+func (c *RateLimitedConn) Write(b []byte) (int, error) {
+	numBytesWritten := 0
+	for numBytesWritten < len(b) {
+		chunk := b[numBytesWritten:min(len(b), numBytesWritten+RATE_LIMIT_QUANTUM)]
+		waitForAll(c.WriteLimiters, len(chunk))
+		n, err := c.Conn.Write(chunk)
+		numBytesWritten += n
+		if err != nil {
+			return numBytesWritten, err
+		}
+	}
+	return numBytesWritten, nil
+}
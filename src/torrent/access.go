@@ -6,6 +6,7 @@ import (
 	"axiomiety/go-bt/data"
 	"bytes"
 	"crypto/sha1"
+	"fmt"
 	"io"
 	"os"
 	"path"
@@ -28,16 +29,22 @@ type Segment struct {
 }
 
 func GetSegmentsForPiece(i *data.BEInfo, index uint32) []Segment {
+	return GetSegments(i, index*i.PieceLength, i.PieceLength)
+}
+
+// GetSegments maps length bytes starting at offset in the torrent's
+// continuous byte stream to the files they belong to
+func GetSegments(i *data.BEInfo, offset uint32, length uint32) []Segment {
 	segments := make([]Segment, 0)
 
-	pieceStart := index * i.PieceLength
-	bytesRemainingInPiece := i.PieceLength
+	pieceStart := offset
+	bytesRemainingInPiece := length
 	runningOffset := uint32(0)
-	for _, file := range i.Files {
+	for _, file := range i.GetFiles() {
 		if bytesRemainingInPiece == 0 || runningOffset > pieceStart+bytesRemainingInPiece {
 			// we're done
 			break
-		} else if (runningOffset + uint32(file.Length)) < pieceStart {
+		} else if (runningOffset + uint32(file.Length)) <= pieceStart {
 			// this is beyond the current file's boundary
 			runningOffset += uint32(file.Length)
 		} else {
@@ -72,3 +79,27 @@ func WriteSegments(segments []Segment, data []byte, baseDir string) {
 		dataOffset += int(segment.Length)
 	}
 }
+
+// ReadSegments is the counterpart to WriteSegments. Unlike writes, which
+// only happen for data we've verified, reads are triggered by peers so we
+// return errors instead of panicking.
+func ReadSegments(segments []Segment, baseDir string) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	for _, segment := range segments {
+		filePath := path.Join(baseDir, segment.Filename)
+		file, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		reader := io.NewSectionReader(file, int64(segment.Offset), int64(segment.Length))
+		numBytesRead, err := io.Copy(buffer, reader)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if numBytesRead < int64(segment.Length) {
+			return nil, fmt.Errorf("%s is shorter than expected", filePath)
+		}
+	}
+	return buffer.Bytes(), nil
+}
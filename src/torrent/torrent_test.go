@@ -133,4 +133,12 @@ func TestWriteSegments(t *testing.T) {
 			t.Errorf("expected %+v, got %+v for %s", contents, buffer, fname)
 		}
 	}
+	// and we should be able to read it all back
+	readBack, err := torrent.ReadSegments(segments, baseDir)
+	if err != nil || !reflect.DeepEqual(readBack, data[2:]) {
+		t.Errorf("expected %+v, got %+v (%v)", data[2:], readBack, err)
+	}
+	if _, err := torrent.ReadSegments([]torrent.Segment{{Filename: "file1", Offset: 2, Length: 10}}, baseDir); err == nil {
+		t.Errorf("expected an error reading past the end of file1")
+	}
 }
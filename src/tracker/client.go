@@ -0,0 +1,208 @@
+package tracker
+
+import (
+	"axiomiety/go-bt/bencode"
+	"axiomiety/go-bt/common"
+	"axiomiety/go-bt/data"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// how long we give a tracker to answer before giving up on it
+const DEFAULT_TRACKER_TIMEOUT = 30 * time.Second
+
+// tracker responses are small - anything bigger than this is a mistake
+const MAX_RESPONSE_SIZE = 2 * 1024 * 1024
+
+const MAX_REDIRECTS = 5
+
+// matches the client part of our peer ID, e.g. go-bt/GB0001
+const DEFAULT_USER_AGENT = "go-bt/" + common.CLIENT_ID + common.CLIENT_VERSION
+
+// Client talks to trackers. The zero value isn't usable, see NewClient.
+type Client struct {
+	HTTP      *http.Client
+	UserAgent string
+}
+
+// NewClient sets up a client that goes through the given proxy - http,
+// https and socks5 URLs all work. Without one, we go by the environment
+// (HTTP_PROXY and friends).
+func NewClient(timeout time.Duration, proxy *url.URL) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	transport.DialContext = (&net.Dialer{Timeout: timeout}).DialContext
+	return &Client{
+		HTTP: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= MAX_REDIRECTS {
+					return fmt.Errorf("stopped after %d redirects", MAX_REDIRECTS)
+				}
+				return nil
+			},
+		},
+		UserAgent: DEFAULT_USER_AGENT,
+	}
+}
+
+var DefaultClient = NewClient(DEFAULT_TRACKER_TIMEOUT, nil)
+
+// withTimeout bounds a request to a UDP tracker the way the HTTP client
+// bounds HTTP ones - left alone, UDP retries go on for hours
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.HTTP.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.HTTP.Timeout)
+}
+
+// get fetches the URL and returns the body, as long as the tracker says
+// it's OK
+func (c *Client) get(ctx context.Context, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	// Go unzips responses it asked to be gzipped, but some trackers do it
+	// regardless
+	if resp.Header.Get("Content-Encoding") == "gzip" && !resp.Uncompressed {
+		unzipped, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer unzipped.Close()
+		body = unzipped
+	}
+	contents, err := io.ReadAll(io.LimitReader(body, MAX_RESPONSE_SIZE+1))
+	if err != nil {
+		return nil, err
+	} else if len(contents) > MAX_RESPONSE_SIZE {
+		return nil, fmt.Errorf("response is over %d bytes", MAX_RESPONSE_SIZE)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// a tracker turning us down may well tell us why
+		if failure, err := decode[data.BETrackerResponse](contents); err == nil && failure.FailureReason != "" {
+			return nil, &FailureError{Reason: failure.FailureReason}
+		}
+		return nil, fmt.Errorf("tracker returned %s", resp.Status)
+	}
+	return contents, nil
+}
+
+// decode parses a bencoded response - the bencode package panics on
+// malformed input, which is no reason for us to
+func decode[S data.BETrackerResponse | data.BEScrapeResponse](contents []byte) (response *S, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			response = nil
+			err = fmt.Errorf("malformed response from tracker: %v", r)
+		}
+	}()
+	return bencode.ParseFromReader[S](bytes.NewReader(contents)), nil
+}
+
+// AnnounceRaw announces us to an HTTP tracker and returns the response
+// as is
+func (c *Client) AnnounceRaw(ctx context.Context, announce *url.URL, q *data.TrackerQuery) ([]byte, error) {
+	// the query string gets written into our own copy of the URL
+	announceURL := *announce
+	announceURL.RawQuery = ToQueryString(q)
+	log.Printf("querying tracker: %s\n", announceURL.String())
+	return c.get(ctx, &announceURL)
+}
+
+// Announce announces us to the tracker, over HTTP or UDP depending on the
+// URL - a failure reason in the response comes back as a *FailureError
+func (c *Client) Announce(ctx context.Context, announce *url.URL, q *data.TrackerQuery) (*data.BETrackerResponse, error) {
+	if announce.Scheme == "udp" {
+		ctx, cancel := c.withTimeout(ctx)
+		defer cancel()
+		return udpTrackerFor(announce.Host).Announce(ctx, q)
+	}
+	contents, err := c.AnnounceRaw(ctx, announce, q)
+	if err != nil {
+		return nil, err
+	}
+	response, err := decode[data.BETrackerResponse](contents)
+	if err != nil {
+		return nil, err
+	}
+	if response.FailureReason != "" {
+		return nil, &FailureError{Reason: response.FailureReason}
+	}
+	if response.WarningMessage != "" {
+		log.Printf("tracker warning: %s", response.WarningMessage)
+	}
+	return response, nil
+}
+
+// Scrape asks the tracker how many seeders, leechers and completed
+// downloads each of the torrents has, over HTTP or UDP depending on the
+// announce URL. Trackers may leave out torrents they don't know about.
+func (c *Client) Scrape(ctx context.Context, announce *url.URL, infoHashes ...[20]byte) (data.BEScrapeFiles, error) {
+	if announce.Scheme == "udp" {
+		files := data.BEScrapeFiles{}
+		for offset := 0; offset < len(infoHashes); offset += UDP_MAX_SCRAPE {
+			chunkCtx, cancel := c.withTimeout(ctx)
+			chunk, err := udpTrackerFor(announce.Host).Scrape(chunkCtx, infoHashes[offset:min(offset+UDP_MAX_SCRAPE, len(infoHashes))]...)
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+			for infoHash, stats := range chunk {
+				files[infoHash] = stats
+			}
+		}
+		return files, nil
+	}
+
+	scrapeURL, err := ScrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	query := scrapeURL.RawQuery
+	for _, infoHash := range infoHashes {
+		if query != "" {
+			query += "&"
+		}
+		query += fmt.Sprintf("info_hash=%s", EncodeBytes(infoHash))
+	}
+	scrapeURL.RawQuery = query
+	contents, err := c.get(ctx, scrapeURL)
+	if err != nil {
+		return nil, err
+	}
+	response, err := decode[data.BEScrapeResponse](contents)
+	if err != nil {
+		return nil, err
+	}
+	if response.FailureReason != "" {
+		return nil, &FailureError{Reason: response.FailureReason}
+	}
+	if response.Files == nil {
+		return nil, errors.New("scrape response has no files")
+	}
+	return response.Files, nil
+}
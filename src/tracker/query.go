@@ -1,17 +1,13 @@
 package tracker
 
 import (
-	"axiomiety/go-bt/bencode"
-	"axiomiety/go-bt/common"
 	"axiomiety/go-bt/data"
-	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
 	"net/url"
 	"reflect"
+	"slices"
 	"strings"
 )
 
@@ -38,49 +34,63 @@ func encodeByte(val byte) string {
 	}
 }
 
+// ToQueryString turns the query into URL parameters, going by the url
+// tags. Tag options are omitempty, to leave out zero values, and escape,
+// for strings that aren't URL-encoded already - the info hash and peer ID
+// are, as they're bytes rather than text.
 func ToQueryString(q *data.TrackerQuery) string {
 	structure := reflect.TypeOf(q).Elem()
 	pairs := []string{}
 	for i := 0; i < structure.NumField(); i++ {
 		f := structure.Field(i)
-		tag := f.Tag.Get("url")
-		if tag != "" {
-			val := reflect.ValueOf(q).Elem().FieldByName(f.Name).Interface()
-			switch f.Type.Kind() {
-			case reflect.String:
-				// empty strings like an empty event= can cause trackers to reject
-				// our request
-				if val != "" {
-					pairs = append(pairs, fmt.Sprintf("%s=%s", tag, val))
-				}
-			case reflect.Uint:
-				pairs = append(pairs, fmt.Sprintf("%s=%d", tag, val))
-			case reflect.Bool:
-				boolAsInt := 0
-				if val.(bool) {
-					boolAsInt = 1
-				}
-				pairs = append(pairs, fmt.Sprintf("%s=%d", tag, boolAsInt))
-			default:
-				panic(fmt.Sprintf("unknown value for tag=%s", tag))
+		tag, options, _ := strings.Cut(f.Tag.Get("url"), ",")
+		if tag == "" {
+			continue
+		}
+		field := reflect.ValueOf(q).Elem().Field(i)
+		optionList := strings.Split(options, ",")
+		if slices.Contains(optionList, "omitempty") && field.IsZero() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			// empty strings like an empty event= can cause trackers to reject
+			// our request
+			val := field.String()
+			if val == "" {
+				continue
+			}
+			if slices.Contains(optionList, "escape") {
+				val = url.QueryEscape(val)
+			}
+			pairs = append(pairs, fmt.Sprintf("%s=%s", tag, val))
+		case reflect.Uint, reflect.Uint32, reflect.Uint64:
+			pairs = append(pairs, fmt.Sprintf("%s=%d", tag, field.Uint()))
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			pairs = append(pairs, fmt.Sprintf("%s=%d", tag, field.Int()))
+		case reflect.Bool:
+			boolAsInt := 0
+			if field.Bool() {
+				boolAsInt = 1
 			}
+			pairs = append(pairs, fmt.Sprintf("%s=%d", tag, boolAsInt))
+		default:
+			panic(fmt.Sprintf("unknown value for tag=%s", tag))
 		}
-
 	}
 	return strings.Join(pairs, "&")
 }
 
-func QueryTrackerRaw(t *url.URL, q *data.TrackerQuery) []byte {
-	t.RawQuery = ToQueryString(q)
-	log.Printf("querying tracker: %s\n", t.String())
-	resp, err := http.Get(t.String())
-	common.Check(err)
-	defer resp.Body.Close()
-	bodyBytes, err := io.ReadAll(resp.Body)
-	common.Check(err)
-	return bodyBytes
+// FailureError is what we get when the tracker turns us down
+type FailureError struct {
+	Reason string
+}
+
+func (e *FailureError) Error() string {
+	return fmt.Sprintf("tracker failure: %s", e.Reason)
 }
 
-func QueryTracker(t *url.URL, q *data.TrackerQuery) *data.BETrackerResponse {
-	return bencode.ParseFromReader[data.BETrackerResponse](bytes.NewReader(QueryTrackerRaw(t, q)))
+// QueryTracker announces us to the tracker with the DefaultClient
+func QueryTracker(t *url.URL, q *data.TrackerQuery) (*data.BETrackerResponse, error) {
+	return DefaultClient.Announce(context.Background(), t, q)
 }
@@ -3,7 +3,19 @@ package tracker_test
 import (
 	"axiomiety/go-bt/data"
 	"axiomiety/go-bt/tracker"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestQueryString(t *testing.T) {
@@ -19,4 +31,307 @@ func TestQueryString(t *testing.T) {
 	if qstring != expected {
 		t.Errorf("expected %s but got %s", expected, qstring)
 	}
+
+	q.Key = "a b"
+	q.IPv4 = "10.0.0.1"
+	q.IPv6 = "::1"
+	q.NoPeerId = true
+	q.SupportCrypto = true
+	q.Corrupt = 16384
+	q.TrackerId = "a&b c"
+	expected = "info_hash=deadbeef&peer_id=foo&port=6682&uploaded=0&downloaded=0&left=3&trackerid=a%26b+c&compact=0&key=a+b&ipv4=10.0.0.1&ipv6=%3A%3A1&no_peer_id=1&supportcrypto=1&corrupt=16384"
+	qstring = tracker.ToQueryString(&q)
+	if qstring != expected {
+		t.Errorf("expected %s but got %s", expected, qstring)
+	}
+}
+
+func TestQueryTracker(t *testing.T) {
+	response := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+	trackerURL, _ := url.Parse(server.URL)
+	q := data.TrackerQuery{InfoHash: "deadbeef", PeerId: "foo", Port: 6682}
+
+	// the same as our own tracker sends
+	response = "d14:failure reason9:not todaye"
+	_, err := tracker.QueryTracker(trackerURL, &q)
+	var failure *tracker.FailureError
+	if !errors.As(err, &failure) || failure.Reason != "not today" {
+		t.Errorf("expected the failure reason to come back as an error, got %v", err)
+	}
+
+	response = "d8:intervali1800e12:min intervali900e5:peersle10:tracker id3:xyz15:warning message7:carefule"
+	trackerResponse, err := tracker.QueryTracker(trackerURL, &q)
+	if err != nil {
+		t.Fatalf("expected a response, got %s", err)
+	}
+	if trackerResponse.Interval != 1800 || trackerResponse.MinInterval != 900 || trackerResponse.TrackerId != "xyz" || trackerResponse.WarningMessage != "careful" {
+		t.Errorf("unexpected response %+v", trackerResponse)
+	}
+}
+
+// udpStandIn is a bare-bones UDP tracker that ignores the first announce
+// it gets, so we have to retry
+func udpStandIn(t *testing.T) (address string, numConnects *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	numConnects = &atomic.Int32{}
+	connectionId := uint64(0xc0ffee)
+	go func() {
+		buffer := make([]byte, 2048)
+		droppedOne := false
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			request := buffer[:n]
+			action := binary.BigEndian.Uint32(request[8:])
+			response := binary.BigEndian.AppendUint32(nil, action)
+			response = append(response, request[12:16]...)
+			switch {
+			case action == tracker.UDP_ACTION_CONNECT && binary.BigEndian.Uint64(request) == tracker.UDP_PROTOCOL_ID:
+				numConnects.Add(1)
+				response = binary.BigEndian.AppendUint64(response, connectionId)
+			case binary.BigEndian.Uint64(request) != connectionId:
+				continue
+			case action == tracker.UDP_ACTION_ANNOUNCE && request[16] == 0xff:
+				response = binary.BigEndian.AppendUint32(nil, tracker.UDP_ACTION_ERROR)
+				response = append(response, request[12:16]...)
+				response = append(response, "not authorized"...)
+			case action == tracker.UDP_ACTION_ANNOUNCE:
+				if !droppedOne {
+					droppedOne = true
+					continue
+				}
+				// interval, leechers, seeders, and the announcing peer
+				response = binary.BigEndian.AppendUint32(response, 1800)
+				response = binary.BigEndian.AppendUint32(response, 1)
+				response = binary.BigEndian.AppendUint32(response, 2)
+				response = append(response, 10, 0, 0, 1)
+				response = append(response, request[96:98]...)
+			case action == tracker.UDP_ACTION_SCRAPE:
+				for range (n - 16) / 20 {
+					response = binary.BigEndian.AppendUint32(response, 2)
+					response = binary.BigEndian.AppendUint32(response, 5)
+					response = binary.BigEndian.AppendUint32(response, 1)
+				}
+			}
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), numConnects
+}
+
+func TestUDPTracker(t *testing.T) {
+	address, numConnects := udpStandIn(t)
+	udpTracker := tracker.NewUDPTracker(address)
+	udpTracker.Timeout = 50 * time.Millisecond
+
+	infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+	q := data.TrackerQuery{
+		InfoHash: tracker.EncodeBytes(infoHash),
+		PeerId:   tracker.EncodeBytes([20]byte{0xff}),
+		Port:     6881,
+		Event:    data.EVENT_STARTED,
+	}
+	response, err := udpTracker.Announce(context.Background(), &q)
+	if err != nil {
+		t.Fatalf("announce failed: %s", err)
+	}
+	expectedPeers := data.BEPeers{{IP: "10.0.0.1", Port: 6881}}
+	if response.Interval != 1800 || response.Incomplete != 1 || response.Complete != 2 || !reflect.DeepEqual(response.Peers, expectedPeers) {
+		t.Errorf("unexpected response %+v", response)
+	}
+
+	files, err := udpTracker.Scrape(context.Background(), infoHash, [20]byte{0xca, 0xfe})
+	if err != nil {
+		t.Fatalf("scrape failed: %s", err)
+	}
+	if len(files) != 2 || files[infoHash] != (data.BEScrapeFile{Complete: 2, Downloaded: 5, Incomplete: 1}) {
+		t.Errorf("unexpected scrape %+v", files)
+	}
+	// the connection ID is good for both
+	if numConnects.Load() != 1 {
+		t.Errorf("expected to connect once, connected %d times", numConnects.Load())
+	}
+
+	q.InfoHash = tracker.EncodeBytes([20]byte{0xff})
+	var failure *tracker.FailureError
+	if _, err := udpTracker.Announce(context.Background(), &q); !errors.As(err, &failure) || failure.Reason != "not authorized" {
+		t.Errorf("expected the tracker's error to come back, got %v", err)
+	}
+
+	// udp:// URLs get picked up automatically
+	q.InfoHash = tracker.EncodeBytes(infoHash)
+	if response, err := tracker.QueryTracker(&url.URL{Scheme: "udp", Host: address}, &q); err != nil || len(response.Peers) != 1 {
+		t.Errorf("expected a response over UDP, got %+v (%v)", response, err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	var handler http.HandlerFunc
+	userAgent := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		userAgent = req.UserAgent()
+		handler(w, req)
+	}))
+	defer server.Close()
+	trackerURL, _ := url.Parse(server.URL + "/announce?key=abc")
+	q := data.TrackerQuery{InfoHash: "deadbeef", PeerId: "foo", Port: 6682}
+	client := tracker.NewClient(50*time.Millisecond, nil)
+
+	handler = func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peerslee"))
+	}
+	if _, err := client.Announce(context.Background(), trackerURL, &q); err != nil {
+		t.Errorf("expected a response, got %s", err)
+	}
+	if userAgent != "go-bt/GB0001" {
+		t.Errorf("expected go-bt/GB0001, got %s", userAgent)
+	}
+	if trackerURL.RawQuery != "key=abc" {
+		t.Errorf("the announce URL shouldn't have changed, got %s", trackerURL)
+	}
+
+	handler = func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zipped := gzip.NewWriter(w)
+		zipped.Write([]byte("d8:intervali1800e5:peerslee"))
+		zipped.Close()
+	}
+	if response, err := client.Announce(context.Background(), trackerURL, &q); err != nil || response.Interval != 1800 {
+		t.Errorf("expected a gzipped response, got %+v (%v)", response, err)
+	}
+
+	handler = func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("d14:failure reason9:not todaye"))
+	}
+	var failure *tracker.FailureError
+	if _, err := client.Announce(context.Background(), trackerURL, &q); !errors.As(err, &failure) || failure.Reason != "not today" {
+		t.Errorf("expected the failure reason to come back as an error, got %v", err)
+	}
+
+	handler = func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	if _, err := client.Announce(context.Background(), trackerURL, &q); err == nil {
+		t.Errorf("expected an error for a bad status code")
+	}
+
+	handler = func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("<html>not a tracker</html>"))
+	}
+	if _, err := client.Announce(context.Background(), trackerURL, &q); err == nil {
+		t.Errorf("expected an error for a malformed response")
+	}
+
+	handler = func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if _, err := client.Announce(context.Background(), trackerURL, &q); err == nil {
+		t.Errorf("expected the announce to time out")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tracker.DefaultClient.Announce(ctx, trackerURL, &q); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the announce to be cancelled, got %v", err)
+	}
+}
+
+func TestUDPTrackerTimeout(t *testing.T) {
+	// nobody's listening on the other end
+	conn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer conn.Close()
+	udpTracker := tracker.NewUDPTracker(conn.LocalAddr().String())
+	udpTracker.Timeout = 10 * time.Millisecond
+	udpTracker.MaxRetries = 2
+	start := time.Now()
+	if _, err := udpTracker.Scrape(context.Background(), [20]byte{}); err == nil {
+		t.Fatalf("expected the scrape to time out")
+	}
+	// 10 + 20 + 40ms
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Errorf("expected to back off between retries, gave up after %s", elapsed)
+	}
+
+	udpTracker.Timeout = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := udpTracker.Scrape(ctx, [20]byte{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the scrape to stop with the context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the scrape to stop with the context, took %s", elapsed)
+	}
+
+	// the client's timeout applies to UDP trackers too
+	client := tracker.NewClient(50*time.Millisecond, nil)
+	start = time.Now()
+	if _, err := client.Scrape(context.Background(), &url.URL{Scheme: "udp", Host: conn.LocalAddr().String()}, [20]byte{}); err == nil {
+		t.Fatalf("expected the scrape to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the client's timeout to apply, took %s", elapsed)
+	}
+}
+
+func TestScrapeURL(t *testing.T) {
+	tests := map[string]string{
+		"http://example.com/announce":          "http://example.com/scrape",
+		"http://example.com/x/announce":        "http://example.com/x/scrape",
+		"http://example.com/announce.php":      "http://example.com/scrape.php",
+		"http://example.com/announce?key=1234": "http://example.com/scrape?key=1234",
+		"http://example.com/a":                 "",
+		"http://example.com/announce/x":        "",
+	}
+	for announce, expected := range tests {
+		announceURL, _ := url.Parse(announce)
+		scrapeURL, err := tracker.ScrapeURL(announceURL)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%s shouldn't be scrapable, got %s", announce, scrapeURL)
+			}
+		} else if err != nil || scrapeURL.String() != expected {
+			t.Errorf("expected %s for %s, got %s (%v)", expected, announce, scrapeURL, err)
+		}
+	}
+}
+
+func TestScrape(t *testing.T) {
+	known := [20]byte{0xde, 0xad}
+	unknown := [20]byte{0xca, 0xfe}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/scrape" || len(req.URL.Query()["info_hash"]) != 2 {
+			w.Write([]byte("d14:failure reason11:bad requeste"))
+			return
+		}
+		fmt.Fprintf(w, "d5:filesd20:%sd8:completei2e10:downloadedi5e10:incompletei1eeee", known[:])
+	}))
+	defer server.Close()
+	announceURL, _ := url.Parse(server.URL + "/announce")
+	files, err := tracker.Scrape(announceURL, known, unknown)
+	if err != nil {
+		t.Fatalf("scrape failed: %s", err)
+	}
+	expected := data.BEScrapeFiles{known: {Complete: 2, Downloaded: 5, Incomplete: 1}}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %+v, got %+v", expected, files)
+	}
+
+	// and the same over UDP
+	address, _ := udpStandIn(t)
+	files, err = tracker.Scrape(&url.URL{Scheme: "udp", Host: address}, known)
+	if err != nil || files[known] != expected[known] {
+		t.Errorf("expected %+v over UDP, got %+v (%v)", expected, files, err)
+	}
 }
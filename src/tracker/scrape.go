@@ -0,0 +1,29 @@
+package tracker
+
+import (
+	"axiomiety/go-bt/data"
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ScrapeURL works out the scrape URL from the announce URL - by convention
+// the last part of the path goes from announce to scrape, and trackers
+// whose announce URL doesn't follow it can't be scraped
+func ScrapeURL(announce *url.URL) (*url.URL, error) {
+	dir, last := path.Split(announce.Path)
+	if !strings.HasPrefix(last, "announce") {
+		return nil, fmt.Errorf("%s doesn't support scraping", announce.String())
+	}
+	scrape := *announce
+	scrape.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+	scrape.RawPath = ""
+	return &scrape, nil
+}
+
+// Scrape scrapes the tracker with the DefaultClient
+func Scrape(announce *url.URL, infoHashes ...[20]byte) (data.BEScrapeFiles, error) {
+	return DefaultClient.Scrape(context.Background(), announce, infoHashes...)
+}
@@ -0,0 +1,185 @@
+package tracker
+
+import (
+	"axiomiety/go-bt/data"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// TrackerStatus is how things have been going with one of our trackers
+type TrackerStatus struct {
+	URL url.URL
+	// nil if the last announce went through
+	LastError    error
+	LastAnnounce time.Time
+	// when the tracker wants to hear from us again
+	NextAnnounce time.Time
+	// how many peers it sent us last time
+	NumPeers int
+	// to be echoed back on our next announces
+	trackerId string
+}
+
+// TrackerList is the tiers of trackers from a torrent's announce-list
+// (BEP 12). Trackers are tried in order within a tier, and the first one
+// that answers moves to the front of it - we only move on to the next tier
+// if none of them do, unless AnnounceToAll is set.
+type TrackerList struct {
+	lock  sync.Mutex
+	Tiers [][]*TrackerStatus
+	// announce to a tracker from every tier rather than just the first
+	// that works, and pool the peers they send us
+	AnnounceToAll bool
+	// the DefaultClient if nil
+	Client *Client
+	// sent along with every announce so trackers can tell it's still us
+	// if our IP changes
+	Key string
+}
+
+// NewTrackerList sets up the tiers from the announce-list, or failing that
+// the single announce URL. Trackers we can't talk to are left out.
+func NewTrackerList(announce string, announceList [][]string) (*TrackerList, error) {
+	if len(announceList) == 0 && announce != "" {
+		announceList = [][]string{{announce}}
+	}
+	l := &TrackerList{Key: fmt.Sprintf("%08x", rand.Uint32())}
+	for _, urls := range announceList {
+		tier := []*TrackerStatus{}
+		for _, rawURL := range urls {
+			trackerURL, err := url.Parse(rawURL)
+			if err != nil {
+				log.Printf("skipping tracker %s: %s", rawURL, err)
+				continue
+			}
+			switch trackerURL.Scheme {
+			case "http", "https", "udp":
+				tier = append(tier, &TrackerStatus{URL: *trackerURL})
+			default:
+				log.Printf("skipping tracker %s: unsupported scheme", rawURL)
+			}
+		}
+		if len(tier) == 0 {
+			continue
+		}
+		// so that everyone doesn't hit the same tracker first
+		rand.Shuffle(len(tier), func(i, j int) { tier[i], tier[j] = tier[j], tier[i] })
+		l.Tiers = append(l.Tiers, tier)
+	}
+	if len(l.Tiers) == 0 {
+		return nil, errors.New("no usable trackers")
+	}
+	return l, nil
+}
+
+// announceTo sends the query to a single tracker and keeps track of how
+// it went. The lock is only held around the status updates, never while
+// we wait on the tracker.
+func (l *TrackerList) announceTo(ctx context.Context, status *TrackerStatus, q data.TrackerQuery) (*data.BETrackerResponse, error) {
+	l.lock.Lock()
+	q.TrackerId = status.trackerId
+	trackerURL := status.URL
+	l.lock.Unlock()
+	if q.Key == "" {
+		q.Key = l.Key
+	}
+	client := l.Client
+	if client == nil {
+		client = DefaultClient
+	}
+	response, err := client.Announce(ctx, &trackerURL, &q)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	status.LastAnnounce = time.Now()
+	status.LastError = err
+	if err != nil {
+		return nil, err
+	}
+	if response.TrackerId != "" {
+		status.trackerId = response.TrackerId
+	}
+	interval := time.Duration(max(response.Interval, response.MinInterval)) * time.Second
+	status.NextAnnounce = status.LastAnnounce.Add(interval)
+	status.NumPeers = len(response.Peers) + len(response.Peers6)
+	return response, nil
+}
+
+// promote moves a tracker that answered to the front of its tier, so it's
+// the first one we try next time
+func (l *TrackerList) promote(tierIdx int, status *TrackerStatus) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	tier := l.Tiers[tierIdx]
+	if idx := slices.Index(tier, status); idx > 0 {
+		copy(tier[1:idx+1], tier[:idx])
+		tier[0] = status
+	}
+}
+
+// Announce goes through the tiers until a tracker answers, or through all
+// of them if AnnounceToAll is set. The response is that of the first
+// tracker that answered, with the peers from any others added in.
+func (l *TrackerList) Announce(ctx context.Context, q *data.TrackerQuery) (*data.BETrackerResponse, error) {
+	// trackers can take a while to answer, so we work off a copy of the
+	// tiers rather than holding the lock throughout
+	l.lock.Lock()
+	tiers := make([][]*TrackerStatus, len(l.Tiers))
+	for idx, tier := range l.Tiers {
+		tiers[idx] = slices.Clone(tier)
+	}
+	announceToAll := l.AnnounceToAll
+	l.lock.Unlock()
+
+	var merged *data.BETrackerResponse
+	errs := []error{}
+	for tierIdx, tier := range tiers {
+		for _, status := range tier {
+			response, err := l.announceTo(ctx, status, *q)
+			if ctx.Err() != nil {
+				// no point trying the others
+				return nil, ctx.Err()
+			} else if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", status.URL.String(), err))
+				continue
+			}
+			l.promote(tierIdx, status)
+			if merged == nil {
+				merged = response
+			} else {
+				merged.Peers = append(merged.Peers, response.Peers...)
+				merged.Peers6 = append(merged.Peers6, response.Peers6...)
+			}
+			break
+		}
+		if merged != nil && !announceToAll {
+			break
+		}
+	}
+	if merged == nil {
+		return nil, errors.Join(errs...)
+	}
+	return merged, nil
+}
+
+// Status returns a copy of every tracker's status, tier by tier
+func (l *TrackerList) Status() [][]TrackerStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	statuses := [][]TrackerStatus{}
+	for _, tier := range l.Tiers {
+		tierStatus := []TrackerStatus{}
+		for _, status := range tier {
+			tierStatus = append(tierStatus, *status)
+		}
+		statuses = append(statuses, tierStatus)
+	}
+	return statuses
+}
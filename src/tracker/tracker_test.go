@@ -1,8 +1,15 @@
 package tracker_test
 
 import (
+	"axiomiety/go-bt/data"
 	"axiomiety/go-bt/tracker"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestByteEncode(t *testing.T) {
@@ -15,3 +22,102 @@ func TestByteEncode(t *testing.T) {
 		t.Errorf("expected %s but got %s", expected, encodedHash)
 	}
 }
+
+func TestTrackerList(t *testing.T) {
+	var lock sync.Mutex
+	hits := map[string]int{}
+	keys := map[string]bool{}
+	// each tracker sends back a single peer on a port of its own
+	trackerServer := func(name string, port int, fail bool) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			lock.Lock()
+			hits[name] += 1
+			keys[req.URL.Query().Get("key")] = true
+			lock.Unlock()
+			if fail {
+				w.Write([]byte("d14:failure reason4:downe"))
+				return
+			}
+			fmt.Fprintf(w, "d8:intervali60e5:peersld2:ip8:10.0.0.14:porti%deeee", port)
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+	down := trackerServer("down", 0, true)
+	up := trackerServer("up", 1, false)
+	backup := trackerServer("backup", 2, false)
+
+	trackers, err := tracker.NewTrackerList("ignored", [][]string{{down, up}, {backup}, {"wss://unsupported"}})
+	if err != nil {
+		t.Fatalf("unable to set up the trackers: %s", err)
+	}
+	if len(trackers.Tiers) != 2 {
+		t.Fatalf("expected the unsupported tracker to be left out, got %d tiers", len(trackers.Tiers))
+	}
+	q := data.TrackerQuery{InfoHash: "deadbeef", PeerId: "foo", Port: 6682}
+	response, err := trackers.Announce(context.Background(), &q)
+	if err != nil || len(response.Peers) != 1 || response.Peers[0].Port != 1 {
+		t.Fatalf("expected a peer from the working tracker, got %+v (%v)", response, err)
+	}
+	// the tracker that works goes to the front of its tier, and we don't
+	// need the backup
+	status := trackers.Status()
+	if status[0][0].URL.String() != up || status[0][0].NumPeers != 1 || status[0][0].LastError != nil {
+		t.Errorf("expected the working tracker to be first in line, got %+v", status[0])
+	}
+	if hits["backup"] != 0 {
+		t.Errorf("the backup tier shouldn't have been used")
+	}
+	if len(keys) != 1 || keys[""] {
+		t.Errorf("expected every tracker to get the same key, got %v", keys)
+	}
+
+	// the first tier being down altogether is what the backup is for
+	downOnly, _ := tracker.NewTrackerList("", [][]string{{down}, {backup}})
+	if response, err := downOnly.Announce(context.Background(), &q); err != nil || response.Peers[0].Port != 2 {
+		t.Errorf("expected to fall back to the second tier, got %+v (%v)", response, err)
+	}
+	if status := downOnly.Status(); status[0][0].LastError == nil {
+		t.Errorf("expected the error to be recorded")
+	}
+
+	// or we can pool everyone's peers
+	trackers.AnnounceToAll = true
+	if response, err := trackers.Announce(context.Background(), &q); err != nil || len(response.Peers) != 2 {
+		t.Errorf("expected peers from both tiers, got %+v (%v)", response, err)
+	}
+}
+
+func TestStatusDuringAnnounce(t *testing.T) {
+	// a slow tracker shouldn't stop anyone from looking at the others
+	answer := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-answer
+		fmt.Fprint(w, "d8:intervali60e5:peerslee")
+	}))
+	t.Cleanup(server.Close)
+	trackers, _ := tracker.NewTrackerList(server.URL, nil)
+	done := make(chan error)
+	go func() {
+		_, err := trackers.Announce(context.Background(), &data.TrackerQuery{InfoHash: "deadbeef", PeerId: "foo"})
+		done <- err
+	}()
+
+	statusDone := make(chan struct{})
+	go func() {
+		trackers.Status()
+		close(statusDone)
+	}()
+	select {
+	case <-statusDone:
+	case <-time.After(time.Second):
+		t.Errorf("Status shouldn't wait on the announce")
+	}
+	close(answer)
+	if err := <-done; err != nil {
+		t.Errorf("expected the announce to go through, got %s", err)
+	}
+	if status := trackers.Status(); status[0][0].LastAnnounce.IsZero() {
+		t.Errorf("expected the announce to be recorded")
+	}
+}
@@ -0,0 +1,272 @@
+package tracker
+
+import (
+	"axiomiety/go-bt/data"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the UDP tracker protocol (BEP 15)
+const (
+	UDP_ACTION_CONNECT  = 0
+	UDP_ACTION_ANNOUNCE = 1
+	UDP_ACTION_SCRAPE   = 2
+	UDP_ACTION_ERROR    = 3
+)
+
+// identifies the protocol in connect requests
+const UDP_PROTOCOL_ID = 0x41727101980
+
+// connection IDs are good for a minute
+const UDP_CONNECTION_TTL = time.Minute
+
+// we wait 15 * 2^n seconds for a response to the nth attempt, and give up
+// after the 8th retry
+const UDP_TIMEOUT = 15 * time.Second
+const UDP_MAX_RETRIES = 8
+
+// how many info hashes fit in a single scrape request
+const UDP_MAX_SCRAPE = 74
+
+var udpEvents = map[string]uint32{
+	"":                   0,
+	data.EVENT_COMPLETED: 1,
+	data.EVENT_STARTED:   2,
+	data.EVENT_STOPPED:   3,
+}
+
+// UDPTracker talks to a tracker over UDP. It holds on to its connection ID
+// in between requests, so there should only be the one per tracker - see
+// udpTrackerFor.
+type UDPTracker struct {
+	Address string
+	// how long we wait on the first attempt, doubling with every retry
+	Timeout    time.Duration
+	MaxRetries int
+
+	lock         sync.Mutex
+	conn         net.Conn
+	connectionId uint64
+	connectedAt  time.Time
+}
+
+func NewUDPTracker(address string) *UDPTracker {
+	return &UDPTracker{
+		Address:    address,
+		Timeout:    UDP_TIMEOUT,
+		MaxRetries: UDP_MAX_RETRIES,
+	}
+}
+
+var udpTrackersLock sync.Mutex
+var udpTrackers = map[string]*UDPTracker{}
+
+func udpTrackerFor(address string) *UDPTracker {
+	udpTrackersLock.Lock()
+	defer udpTrackersLock.Unlock()
+	if _, ok := udpTrackers[address]; !ok {
+		udpTrackers[address] = NewUDPTracker(address)
+	}
+	return udpTrackers[address]
+}
+
+// errTimeout means the tracker didn't get back to us in time - we can
+// try again
+var errTimeout = errors.New("timed out waiting for the tracker")
+
+// exchange sends a single request and waits for the response that goes
+// with it. The caller must hold the lock.
+func (u *UDPTracker) exchange(connectionId uint64, action uint32, payload []byte, timeout time.Duration) ([]byte, error) {
+	transactionId := make([]byte, 4)
+	rand.Read(transactionId)
+	request := make([]byte, 16, 16+len(payload))
+	binary.BigEndian.PutUint64(request, connectionId)
+	binary.BigEndian.PutUint32(request[8:], action)
+	copy(request[12:], transactionId)
+	if _, err := u.conn.Write(append(request, payload...)); err != nil {
+		return nil, err
+	}
+
+	u.conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := u.conn.Read(buffer)
+		if os.IsTimeout(err) {
+			return nil, errTimeout
+		} else if err != nil {
+			return nil, err
+		}
+		// anything else is a late response to an earlier attempt
+		if n < 8 || string(buffer[4:8]) != string(transactionId) {
+			continue
+		}
+		switch responseAction := binary.BigEndian.Uint32(buffer); responseAction {
+		case action:
+			return buffer[8:n], nil
+		case UDP_ACTION_ERROR:
+			return nil, &FailureError{Reason: string(buffer[8:n])}
+		default:
+			return nil, fmt.Errorf("expected action %d from the tracker, got %d", action, responseAction)
+		}
+	}
+}
+
+// request gets a connection ID if we need one, and then sends the
+// request, retrying as long as the tracker doesn't get back to us and ctx
+// isn't done
+func (u *UDPTracker) request(ctx context.Context, action uint32, payload []byte) ([]byte, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.conn == nil {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "udp", u.Address)
+		if err != nil {
+			return nil, err
+		}
+		u.conn = conn
+	}
+	// wakes up whichever read we're waiting on
+	stop := context.AfterFunc(ctx, func() { u.conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	for attempt := range u.MaxRetries + 1 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		timeout := u.Timeout << attempt
+		if time.Since(u.connectedAt) > UDP_CONNECTION_TTL {
+			response, err := u.exchange(UDP_PROTOCOL_ID, UDP_ACTION_CONNECT, nil, timeout)
+			if err == errTimeout {
+				continue
+			} else if err != nil {
+				return nil, err
+			} else if len(response) < 8 {
+				return nil, fmt.Errorf("connect response of %d bytes is too short", len(response))
+			}
+			u.connectionId = binary.BigEndian.Uint64(response)
+			u.connectedAt = time.Now()
+		}
+		response, err := u.exchange(u.connectionId, action, payload, timeout)
+		if err == errTimeout {
+			continue
+		} else if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var failure *FailureError
+		if errors.As(err, &failure) {
+			// it may well be down to our connection ID, so we get a new one
+			// next time
+			u.connectedAt = time.Time{}
+		}
+		return response, err
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, fmt.Errorf("%s: %w", u.Address, errTimeout)
+}
+
+// Announce is the UDP equivalent of an HTTP announce. The info hash and
+// peer ID in the query are URL-encoded, as for HTTP trackers.
+func (u *UDPTracker) Announce(ctx context.Context, q *data.TrackerQuery) (*data.BETrackerResponse, error) {
+	infoHash, err := url.QueryUnescape(q.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	peerId, err := url.QueryUnescape(q.PeerId)
+	if err != nil {
+		return nil, err
+	}
+	event, ok := udpEvents[q.Event]
+	if !ok {
+		return nil, fmt.Errorf("unknown event %q", q.Event)
+	}
+	if len(infoHash) != 20 || len(peerId) != 20 {
+		return nil, errors.New("the info hash and peer ID must be 20 bytes long")
+	}
+	payload := make([]byte, 82)
+	copy(payload, infoHash)
+	copy(payload[20:], peerId)
+	binary.BigEndian.PutUint64(payload[40:], uint64(q.Downloaded))
+	binary.BigEndian.PutUint64(payload[48:], uint64(q.Left))
+	binary.BigEndian.PutUint64(payload[56:], uint64(q.Uploaded))
+	binary.BigEndian.PutUint32(payload[64:], event)
+	// the tracker works out our IP if we leave it at 0
+	for _, ip := range []string{q.IPv4, q.IP} {
+		if ipv4 := net.ParseIP(ip).To4(); ipv4 != nil {
+			copy(payload[68:], ipv4)
+			break
+		}
+	}
+	// HTTP keys are free-form, we can only pass on the ones that fit
+	if key, err := strconv.ParseUint(q.Key, 16, 32); err == nil {
+		binary.BigEndian.PutUint32(payload[72:], uint32(key))
+	} else {
+		rand.Read(payload[72:76])
+	}
+	// -1 lets the tracker decide how many peers to send us
+	numWant := int32(-1)
+	if q.Numwant > 0 {
+		numWant = int32(q.Numwant)
+	}
+	binary.BigEndian.PutUint32(payload[76:], uint32(numWant))
+	binary.BigEndian.PutUint16(payload[80:], uint16(q.Port))
+
+	response, err := u.request(ctx, UDP_ACTION_ANNOUNCE, payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12 {
+		return nil, fmt.Errorf("announce response of %d bytes is too short", len(response))
+	}
+	trackerResponse := &data.BETrackerResponse{
+		Interval:   int64(binary.BigEndian.Uint32(response)),
+		Incomplete: int64(binary.BigEndian.Uint32(response[4:])),
+		Complete:   int64(binary.BigEndian.Uint32(response[8:])),
+	}
+	// peers come in the same form as compact peers, and they're IPv6
+	// peers if we're talking to the tracker over IPv6
+	peers := string(response[12:])
+	if remote, ok := u.conn.RemoteAddr().(*net.UDPAddr); ok && remote.IP.To4() == nil {
+		err = trackerResponse.Peers6.UnmarshalBencode(peers)
+	} else {
+		err = trackerResponse.Peers.UnmarshalBencode(peers)
+	}
+	return trackerResponse, err
+}
+
+// Scrape asks the tracker about the torrents with the given info hashes
+func (u *UDPTracker) Scrape(ctx context.Context, infoHashes ...[20]byte) (data.BEScrapeFiles, error) {
+	if len(infoHashes) > UDP_MAX_SCRAPE {
+		return nil, fmt.Errorf("can only scrape up to %d torrents at once", UDP_MAX_SCRAPE)
+	}
+	payload := []byte{}
+	for _, infoHash := range infoHashes {
+		payload = append(payload, infoHash[:]...)
+	}
+	response, err := u.request(ctx, UDP_ACTION_SCRAPE, payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response of %d bytes is too short", len(response))
+	}
+	files := data.BEScrapeFiles{}
+	for idx, infoHash := range infoHashes {
+		stats := response[12*idx:]
+		files[infoHash] = data.BEScrapeFile{
+			Complete:   int64(binary.BigEndian.Uint32(stats)),
+			Downloaded: int64(binary.BigEndian.Uint32(stats[4:])),
+			Incomplete: int64(binary.BigEndian.Uint32(stats[8:])),
+		}
+	}
+	return files, nil
+}